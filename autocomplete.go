@@ -0,0 +1,111 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+// Discord shows at most this many suggestions
+const maxChoices = 25
+
+// autocomplete suggests the registered categories for options named
+// "category", and the roles assigned to one for options named "role". Only
+// the options with Autocomplete set ever get here. There's no access check,
+// every member can see the role names anyway.
+func autocomplete(s *discordgo.Session, i *discordgo.InteractionCreate, store CategoryStore) {
+	focused := focusedOption(i.ApplicationCommandData().Options)
+	if focused == nil {
+		return
+	}
+
+	var ids []string
+	switch focused.Name {
+	case "category":
+		cats, err := store.Categories(i.GuildID)
+		if err != nil {
+			fmt.Println(err)
+		}
+		for _, k := range cats {
+			ids = append(ids, k.Role)
+		}
+	case "role":
+		roles, err := store.Roles(i.GuildID)
+		if err != nil {
+			fmt.Println(err)
+		}
+		seen := make(map[string]bool)
+		for _, k := range roles {
+			if !seen[k.Role] {
+				seen[k.Role] = true
+				ids = append(ids, k.Role)
+			}
+		}
+	}
+
+	guild, _ := s.State.Guild(i.GuildID)
+	typed := strings.ToLower(strings.TrimSpace(focused.StringValue()))
+	choices := []*discordgo.ApplicationCommandOptionChoice{}
+	for _, id := range ids {
+		name := id
+		if guild != nil {
+			if role := findRole(guild, id); role != nil {
+				name = role.Name
+			}
+		}
+		if !strings.Contains(strings.ToLower(name), typed) && !strings.Contains(id, typed) {
+			continue
+		}
+		choices = append(choices, &discordgo.ApplicationCommandOptionChoice{Name: name, Value: id})
+		if len(choices) == maxChoices {
+			break
+		}
+	}
+
+	err := s.InteractionRespond(i.Interaction, &discordgo.InteractionResponse{
+		Type: discordgo.InteractionApplicationCommandAutocompleteResult,
+		Data: &discordgo.InteractionResponseData{
+			Choices: choices,
+		},
+	})
+	if err != nil {
+		fmt.Println(err)
+	}
+}
+
+// focusedOption finds the option the user is typing in, which may be inside
+// a subcommand.
+func focusedOption(options []*discordgo.ApplicationCommandInteractionDataOption) *discordgo.ApplicationCommandInteractionDataOption {
+	for _, o := range options {
+		if o.Focused {
+			return o
+		}
+		if f := focusedOption(o.Options); f != nil {
+			return f
+		}
+	}
+	return nil
+}
+
+// resolveRole turns the value of an autocompleted option into a role ID.
+// Picking a suggestion gives the ID already, but users can also type a
+// mention or a role's name. Anything else is returned as is, and the store
+// then rejects it with its usual error.
+func resolveRole(s *discordgo.Session, gid string, value string) string {
+	value = strings.TrimSpace(value)
+	if strings.HasPrefix(value, "<@&") && strings.HasSuffix(value, ">") {
+		return value[3 : len(value)-1]
+	}
+
+	guild, err := s.State.Guild(gid)
+	if err != nil || findRole(guild, value) != nil {
+		return value
+	}
+	for _, role := range guild.Roles {
+		if strings.EqualFold(role.Name, value) {
+			return role.ID
+		}
+	}
+	return value
+}
@@ -0,0 +1,662 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+// lookupCategory finds a category's settings, or returns errNotCategory.
+func lookupCategory(store CategoryStore, gid string, cat string) (categoryHolder, error) {
+	gCat, err := store.Categories(gid)
+	if err != nil {
+		return categoryHolder{}, err
+	}
+	for _, k := range gCat {
+		if k.Role == cat {
+			return k, nil
+		}
+	}
+	return categoryHolder{}, errNotCategory
+}
+
+// categoriesOf lists the categories role belongs to.
+func categoriesOf(store CategoryStore, gid string, role string) (cats []string, err error) {
+	gRoles, err := store.Roles(gid)
+	if err != nil {
+		return
+	}
+	for _, k := range gRoles {
+		if k.Role == role {
+			cats = append(cats, k.Category)
+		}
+	}
+	return
+}
+
+// isExclusive reports whether cat is an exclusive category.
+func isExclusive(store CategoryStore, gid string, cat string) (bool, error) {
+	k, err := lookupCategory(store, gid, cat)
+	if err == errNotCategory {
+		return false, nil
+	}
+	return k.Exclusive, err
+}
+
+// errExclusiveThreshold is why a category can't be exclusive and need more
+// than one role at the same time.
+var errExclusiveThreshold = errors.New("Members can only have one role from an exclusive category, so it can't need more than one!")
+
+// optionMap indexes a command's options by name.
+func optionMap(options []*discordgo.ApplicationCommandInteractionDataOption) map[string]*discordgo.ApplicationCommandInteractionDataOption {
+	m := make(map[string]*discordgo.ApplicationCommandInteractionDataOption, len(options))
+	for _, o := range options {
+		m[o.Name] = o
+	}
+	return m
+}
+
+// categoryCreate turns a role into a category.
+func categoryCreate(s *discordgo.Session, i *discordgo.InteractionCreate, store CategoryStore, cat string) {
+	margs := []interface{}{
+		cat,
+	}
+	var msgformat string
+	mr, err := checkAccess(i.Member, i.GuildID, s, store, false)
+	if err != nil || mr == false {
+		if err != nil {
+			msgformat = err.Error()
+		} else {
+			msgformat = "User does not have manage roles permission or a manager role!"
+		}
+		s.InteractionRespond(i.Interaction, &discordgo.InteractionResponse{
+			Type: discordgo.InteractionResponseChannelMessageWithSource,
+			Data: &discordgo.InteractionResponseData{
+				Content: msgformat,
+			},
+		})
+		return
+	}
+	// refuse categories the bot could never give to anyone
+	err = checkAssignable(s, i.GuildID, cat, i.Member)
+	if err == nil {
+		err = store.AddCategory(cat, i.GuildID)
+	}
+	if err != nil {
+		msgformat = err.Error()
+		s.InteractionRespond(i.Interaction, &discordgo.InteractionResponse{
+			Type: discordgo.InteractionResponseChannelMessageWithSource,
+			Data: &discordgo.InteractionResponseData{
+				Content: msgformat,
+			},
+		})
+		return
+	} else {
+		msgformat = `role <@&%s> is now a category!`
+		// disable mentions by passing a zero'd allowmentions
+		var allowedMentions discordgo.MessageAllowedMentions
+		s.InteractionRespond(i.Interaction, &discordgo.InteractionResponse{
+			Type: discordgo.InteractionResponseChannelMessageWithSource,
+			Data: &discordgo.InteractionResponseData{
+				AllowedMentions: &allowedMentions,
+				Content: fmt.Sprintf(
+					msgformat,
+					margs...,
+				),
+			},
+		})
+	}
+}
+
+// categoryAddRole assigns a role to a category.
+func categoryAddRole(s *discordgo.Session, i *discordgo.InteractionCreate, store CategoryStore, cat string, role string) {
+	margs := []interface{}{
+		cat,
+		role,
+	}
+	var msgformat string
+	mr, err := checkAccess(i.Member, i.GuildID, s, store, false)
+	if err != nil || mr == false {
+		if err != nil {
+			msgformat = err.Error()
+		} else {
+			msgformat = "User does not have manage roles permission or a manager role!"
+		}
+		s.InteractionRespond(i.Interaction, &discordgo.InteractionResponse{
+			Type: discordgo.InteractionResponseChannelMessageWithSource,
+			Data: &discordgo.InteractionResponseData{
+				Content: msgformat,
+			},
+		})
+		return
+	}
+	// refuse categories the bot could never give to anyone
+	err = checkAssignable(s, i.GuildID, cat, i.Member)
+	if err == nil {
+		// panels would let anyone pick it
+		err = checkInvoker(s, i.GuildID, role, i.Member)
+	}
+	if err == nil {
+		err = store.SetCategory(cat, role, i.GuildID)
+	}
+	if err != nil {
+		msgformat = err.Error()
+		s.InteractionRespond(i.Interaction, &discordgo.InteractionResponse{
+			Type: discordgo.InteractionResponseChannelMessageWithSource,
+			Data: &discordgo.InteractionResponseData{
+				Content: msgformat,
+			},
+		})
+	} else {
+		msgformat = `category <@&%s> now contains role <@&%s>`
+		if exclusive, _ := isExclusive(store, i.GuildID, cat); exclusive {
+			msgformat += `. The category is exclusive, so members with another of its roles will only keep one of them.`
+		}
+		// disable mentions by passing a zero'd allowmentions
+		var allowedMentions discordgo.MessageAllowedMentions
+		s.InteractionRespond(i.Interaction, &discordgo.InteractionResponse{
+			Type: discordgo.InteractionResponseChannelMessageWithSource,
+			Data: &discordgo.InteractionResponseData{
+				AllowedMentions: &allowedMentions,
+				Content: fmt.Sprintf(
+					msgformat,
+					margs...,
+				),
+			},
+		})
+		positionAfterChange(s, i, store)
+		applyMappingChange(s, i, store, role)
+	}
+}
+
+// maxBulkRoles is how many roles /category add-roles takes at once.
+const maxBulkRoles = 10
+
+// bulkRoleOptions returns the role-1 to role-10 options of /category add-roles.
+func bulkRoleOptions() (options []*discordgo.ApplicationCommandOption) {
+	for n := 1; n <= maxBulkRoles; n++ {
+		options = append(options, &discordgo.ApplicationCommandOption{
+			Type:        discordgo.ApplicationCommandOptionRole,
+			Name:        fmt.Sprintf("role-%d", n),
+			Description: "Role to assign to category",
+			Required:    n == 1,
+		})
+	}
+	return
+}
+
+// bulkRoles returns the roles given to /category add-roles, without duplicates.
+func bulkRoles(opts map[string]*discordgo.ApplicationCommandInteractionDataOption) (roles []string) {
+	seen := make(map[string]bool)
+	for n := 1; n <= maxBulkRoles; n++ {
+		o, ok := opts[fmt.Sprintf("role-%d", n)]
+		if !ok {
+			continue
+		}
+		role := o.RoleValue(nil, "").ID
+		if !seen[role] {
+			seen[role] = true
+			roles = append(roles, role)
+		}
+	}
+	return
+}
+
+// categoryAddRoles assigns several roles to a category at once, and lists
+// which of them it couldn't assign.
+func categoryAddRoles(s *discordgo.Session, i *discordgo.InteractionCreate, store CategoryStore, cat string, roles []string) {
+	var msgformat string
+	mr, err := checkAccess(i.Member, i.GuildID, s, store, false)
+	if err != nil || mr == false {
+		if err != nil {
+			msgformat = err.Error()
+		} else {
+			msgformat = "User does not have manage roles permission or a manager role!"
+		}
+		s.InteractionRespond(i.Interaction, &discordgo.InteractionResponse{
+			Type: discordgo.InteractionResponseChannelMessageWithSource,
+			Data: &discordgo.InteractionResponseData{
+				Content: msgformat,
+			},
+		})
+		return
+	}
+	// refuse categories the bot could never give to anyone
+	var failed map[string]error
+	err = checkAssignable(s, i.GuildID, cat, i.Member)
+	if err == nil {
+		// panels would let anyone pick the roles
+		refused := make(map[string]error)
+		var allowed []string
+		for _, role := range roles {
+			if err := checkInvoker(s, i.GuildID, role, i.Member); err != nil {
+				refused[role] = err
+			} else {
+				allowed = append(allowed, role)
+			}
+		}
+		failed, err = store.SetCategories(cat, allowed, i.GuildID)
+		for role, err := range failed {
+			refused[role] = err
+		}
+		failed = refused
+	}
+	if err != nil {
+		msgformat = err.Error()
+		s.InteractionRespond(i.Interaction, &discordgo.InteractionResponse{
+			Type: discordgo.InteractionResponseChannelMessageWithSource,
+			Data: &discordgo.InteractionResponseData{
+				Content: msgformat,
+			},
+		})
+		return
+	}
+
+	var added []string
+	var b strings.Builder
+	for _, role := range roles {
+		if err, ok := failed[role]; ok {
+			fmt.Fprintf(&b, "<@&%s>: %s\n", role, err.Error())
+			continue
+		}
+		added = append(added, role)
+		fmt.Fprintf(&b, "<@&%s>: added to <@&%s>\n", role, cat)
+	}
+	// disable mentions by passing a zero'd allowmentions
+	var allowedMentions discordgo.MessageAllowedMentions
+	s.InteractionRespond(i.Interaction, &discordgo.InteractionResponse{
+		Type: discordgo.InteractionResponseChannelMessageWithSource,
+		Data: &discordgo.InteractionResponseData{
+			AllowedMentions: &allowedMentions,
+			Content:         b.String(),
+		},
+	})
+	if len(added) > 0 {
+		positionAfterChange(s, i, store)
+		applyMappingChange(s, i, store, added...)
+	}
+}
+
+// categoryDelete turns a category back into a normal role, unassigns its
+// roles and takes it away from the members who have it.
+func categoryDelete(s *discordgo.Session, i *discordgo.InteractionCreate, store CategoryStore, cat string) {
+	margs := []interface{}{
+		cat,
+	}
+	var msgformat string
+	mr, err := checkAccess(i.Member, i.GuildID, s, store, false)
+	if err != nil || mr == false {
+		if err != nil {
+			msgformat = err.Error()
+		} else {
+			msgformat = "User does not have manage roles permission or a manager role!"
+		}
+		s.InteractionRespond(i.Interaction, &discordgo.InteractionResponse{
+			Type: discordgo.InteractionResponseChannelMessageWithSource,
+			Data: &discordgo.InteractionResponseData{
+				Content: msgformat,
+			},
+		})
+		return
+	}
+	err = checkInvoker(s, i.GuildID, cat, i.Member)
+	if err == nil {
+		err = store.RemoveCategory(cat, i.GuildID)
+	}
+	if err != nil {
+		msgformat = err.Error()
+		s.InteractionRespond(i.Interaction, &discordgo.InteractionResponse{
+			Type: discordgo.InteractionResponseChannelMessageWithSource,
+			Data: &discordgo.InteractionResponseData{
+				Content: msgformat,
+			},
+		})
+	} else {
+		msgformat = `<@&%s> is no longer a category!`
+		// disable mentions by passing a zero'd allowmentions
+		var allowedMentions discordgo.MessageAllowedMentions
+		s.InteractionRespond(i.Interaction, &discordgo.InteractionResponse{
+			Type: discordgo.InteractionResponseChannelMessageWithSource,
+			Data: &discordgo.InteractionResponseData{
+				AllowedMentions: &allowedMentions,
+				Content: fmt.Sprintf(
+					msgformat,
+					margs...,
+				),
+			},
+		})
+		go refreshPanels(s, store, i.GuildID)
+		applyCategoryDelete(s, i, store, cat)
+	}
+}
+
+// categoryMoveRole moves a role to a different category.
+func categoryMoveRole(s *discordgo.Session, i *discordgo.InteractionCreate, store CategoryStore, cat string, role string) {
+	margs := []interface{}{
+		role,
+		cat,
+	}
+	var msgformat string
+	mr, err := checkAccess(i.Member, i.GuildID, s, store, false)
+	if err != nil || mr == false {
+		if err != nil {
+			msgformat = err.Error()
+		} else {
+			msgformat = "User does not have manage roles permission or a manager role!"
+		}
+		s.InteractionRespond(i.Interaction, &discordgo.InteractionResponse{
+			Type: discordgo.InteractionResponseChannelMessageWithSource,
+			Data: &discordgo.InteractionResponseData{
+				Content: msgformat,
+			},
+		})
+		return
+	}
+	// refuse categories the bot could never give to anyone
+	err = checkAssignable(s, i.GuildID, cat, i.Member)
+	if err == nil {
+		// the role leaves its other categories, and panels would let
+		// anyone pick it
+		var from []string
+		from, err = categoriesOf(store, i.GuildID, role)
+		if err == nil {
+			err = checkInvokerRoles(s, i.GuildID, append(from, role), i.Member)
+		}
+	}
+	if err == nil {
+		err = store.UpdateCategory(cat, role, i.GuildID)
+	}
+	if err != nil {
+		msgformat = err.Error()
+		s.InteractionRespond(i.Interaction, &discordgo.InteractionResponse{
+			Type: discordgo.InteractionResponseChannelMessageWithSource,
+			Data: &discordgo.InteractionResponseData{
+				Content: msgformat,
+			},
+		})
+	} else {
+		msgformat = `<@&%s> is now part of <@&%s>!`
+		// disable mentions by passing a zero'd allowmentions
+		var allowedMentions discordgo.MessageAllowedMentions
+		s.InteractionRespond(i.Interaction, &discordgo.InteractionResponse{
+			Type: discordgo.InteractionResponseChannelMessageWithSource,
+			Data: &discordgo.InteractionResponseData{
+				AllowedMentions: &allowedMentions,
+				Content: fmt.Sprintf(
+					msgformat,
+					margs...,
+				),
+			},
+		})
+		positionAfterChange(s, i, store)
+		applyMappingChange(s, i, store, role)
+	}
+}
+
+// categorySetExclusive changes whether members may hold more than one of a
+// category's roles, and lists the members who already have more than one.
+func categorySetExclusive(s *discordgo.Session, i *discordgo.InteractionCreate, store CategoryStore, cat string, exclusive bool) {
+	var msgformat string
+	mr, err := checkAccess(i.Member, i.GuildID, s, store, false)
+	if err != nil || mr == false {
+		if err != nil {
+			msgformat = err.Error()
+		} else {
+			msgformat = "User does not have manage roles permission or a manager role!"
+		}
+		s.InteractionRespond(i.Interaction, &discordgo.InteractionResponse{
+			Type: discordgo.InteractionResponseChannelMessageWithSource,
+			Data: &discordgo.InteractionResponseData{
+				Content: msgformat,
+			},
+		})
+		return
+	}
+	err = checkInvoker(s, i.GuildID, cat, i.Member)
+	var k categoryHolder
+	if err == nil {
+		k, err = lookupCategory(store, i.GuildID, cat)
+	}
+	if err == nil && exclusive && k.minRoles() > 1 {
+		err = errExclusiveThreshold
+	}
+	if err == nil {
+		err = store.SetExclusive(cat, exclusive, i.GuildID)
+	}
+	if err != nil {
+		msgformat = err.Error()
+		s.InteractionRespond(i.Interaction, &discordgo.InteractionResponse{
+			Type: discordgo.InteractionResponseChannelMessageWithSource,
+			Data: &discordgo.InteractionResponseData{
+				Content: msgformat,
+			},
+		})
+		return
+	}
+
+	if exclusive {
+		msgformat = `Members can now only have one role from <@&%s>.`
+	} else {
+		msgformat = `Members can now have any number of roles from <@&%s>.`
+	}
+	// disable mentions by passing a zero'd allowmentions
+	var allowedMentions discordgo.MessageAllowedMentions
+	s.InteractionRespond(i.Interaction, &discordgo.InteractionResponse{
+		Type: discordgo.InteractionResponseChannelMessageWithSource,
+		Data: &discordgo.InteractionResponseData{
+			AllowedMentions: &allowedMentions,
+			Content:         fmt.Sprintf(msgformat, cat),
+		},
+	})
+
+	var roles []string
+	gRoles, err := store.Roles(i.GuildID)
+	if err != nil {
+		fmt.Println(err)
+	}
+	for _, k := range gRoles {
+		if k.Category == cat {
+			roles = append(roles, k.Role)
+		}
+	}
+	if exclusive && len(roles) > 0 {
+		applyMappingChange(s, i, store, roles...)
+	} else {
+		go refreshPanels(s, store, i.GuildID)
+	}
+}
+
+// categorySetThreshold changes how many of a category's roles members need
+// before they get the category, and fixes the members holding its roles.
+func categorySetThreshold(s *discordgo.Session, i *discordgo.InteractionCreate, store CategoryStore, cat string, count int) {
+	var msgformat string
+	mr, err := checkAccess(i.Member, i.GuildID, s, store, false)
+	if err != nil || mr == false {
+		if err != nil {
+			msgformat = err.Error()
+		} else {
+			msgformat = "User does not have manage roles permission or a manager role!"
+		}
+		s.InteractionRespond(i.Interaction, &discordgo.InteractionResponse{
+			Type: discordgo.InteractionResponseChannelMessageWithSource,
+			Data: &discordgo.InteractionResponseData{
+				Content: msgformat,
+			},
+		})
+		return
+	}
+	err = checkInvoker(s, i.GuildID, cat, i.Member)
+	var k categoryHolder
+	if err == nil {
+		k, err = lookupCategory(store, i.GuildID, cat)
+	}
+	if err == nil && k.Exclusive && count > 1 {
+		err = errExclusiveThreshold
+	}
+	if err == nil {
+		err = store.SetThreshold(cat, count, i.GuildID)
+	}
+	if err != nil {
+		msgformat = err.Error()
+		s.InteractionRespond(i.Interaction, &discordgo.InteractionResponse{
+			Type: discordgo.InteractionResponseChannelMessageWithSource,
+			Data: &discordgo.InteractionResponseData{
+				Content: msgformat,
+			},
+		})
+		return
+	}
+
+	if count > 1 {
+		msgformat = fmt.Sprintf(`Members now need %d roles from <@&%s> to get it.`, count, cat)
+	} else {
+		msgformat = fmt.Sprintf(`Members now get <@&%s> with any one of its roles.`, cat)
+	}
+	// disable mentions by passing a zero'd allowmentions
+	var allowedMentions discordgo.MessageAllowedMentions
+	s.InteractionRespond(i.Interaction, &discordgo.InteractionResponse{
+		Type: discordgo.InteractionResponseChannelMessageWithSource,
+		Data: &discordgo.InteractionResponseData{
+			AllowedMentions: &allowedMentions,
+			Content:         msgformat,
+		},
+	})
+
+	var roles []string
+	gRoles, err := store.Roles(i.GuildID)
+	if err != nil {
+		fmt.Println(err)
+	}
+	for _, k := range gRoles {
+		if k.Category == cat {
+			roles = append(roles, k.Role)
+		}
+	}
+	if len(roles) > 0 {
+		applyMappingChange(s, i, store, roles...)
+	}
+}
+
+// categoryRemoveRole unassigns a role from cat, or from every category it
+// is in if cat is empty.
+func categoryRemoveRole(s *discordgo.Session, i *discordgo.InteractionCreate, store CategoryStore, cat string, role string) {
+	margs := []interface{}{
+		role,
+	}
+	var msgformat string
+	mr, err := checkAccess(i.Member, i.GuildID, s, store, false)
+	if err != nil || mr == false {
+		if err != nil {
+			msgformat = err.Error()
+		} else {
+			msgformat = "User does not have manage roles permission or a manager role!"
+		}
+		s.InteractionRespond(i.Interaction, &discordgo.InteractionResponse{
+			Type: discordgo.InteractionResponseChannelMessageWithSource,
+			Data: &discordgo.InteractionResponseData{
+				Content: msgformat,
+			},
+		})
+		return
+	}
+	cats := []string{cat}
+	if cat == "" {
+		cats, err = categoriesOf(store, i.GuildID, role)
+	}
+	if err == nil {
+		err = checkInvokerRoles(s, i.GuildID, cats, i.Member)
+	}
+	if err == nil {
+		err = store.UnsetCategory(cat, role, i.GuildID)
+	}
+	if err != nil {
+		msgformat = err.Error()
+		s.InteractionRespond(i.Interaction, &discordgo.InteractionResponse{
+			Type: discordgo.InteractionResponseChannelMessageWithSource,
+			Data: &discordgo.InteractionResponseData{
+				Content: msgformat,
+			},
+		})
+	} else {
+		msgformat = `<@&%s> is no longer part of a category!`
+		if cat != "" {
+			msgformat = `<@&%s> is no longer part of <@&%s>!`
+			margs = append(margs, cat)
+		}
+		// disable mentions by passing a zero'd allowmentions
+		var allowedMentions discordgo.MessageAllowedMentions
+		s.InteractionRespond(i.Interaction, &discordgo.InteractionResponse{
+			Type: discordgo.InteractionResponseChannelMessageWithSource,
+			Data: &discordgo.InteractionResponseData{
+				AllowedMentions: &allowedMentions,
+				Content: fmt.Sprintf(
+					msgformat,
+					margs...,
+				),
+			},
+		})
+		applyMappingChange(s, i, store, role)
+	}
+}
+
+// categoryList lists every category and its roles.
+func categoryList(s *discordgo.Session, i *discordgo.InteractionCreate, store CategoryStore) {
+	var msgformat string
+	mr, err := checkAccess(i.Member, i.GuildID, s, store, true)
+	if err != nil || mr == false {
+		if err != nil {
+			msgformat = err.Error()
+		} else {
+			msgformat = "User does not have manage roles permission or a manager role!"
+		}
+		s.InteractionRespond(i.Interaction, &discordgo.InteractionResponse{
+			Type: discordgo.InteractionResponseChannelMessageWithSource,
+			Data: &discordgo.InteractionResponseData{
+				Content: msgformat,
+			},
+		})
+		return
+	}
+	roles, err := listRoles(i.GuildID, store)
+	if err != nil {
+		msgformat = err.Error()
+		s.InteractionRespond(i.Interaction, &discordgo.InteractionResponse{
+			Type: discordgo.InteractionResponseChannelMessageWithSource,
+			Data: &discordgo.InteractionResponseData{
+				Content: msgformat,
+			},
+		})
+	} else {
+		var embed discordgo.MessageEmbed
+		embed.Color = 0xCC00CC
+		embed.Title = "Categories"
+		embed.Description = ""
+		for _, n := range roles {
+			embed.Description += "<@&" + n.Category + ">"
+			if n.Exclusive {
+				embed.Description += " (exclusive)"
+			}
+			if n.MinCount > 1 {
+				embed.Description += fmt.Sprintf(" (needs %d roles)", n.MinCount)
+			}
+			embed.Description += "\n"
+			for _, k := range n.Roles {
+				embed.Description += "<@&" + k + "> "
+			}
+			embed.Description += "\n"
+		}
+		var embeds []*discordgo.MessageEmbed
+		embeds = append(embeds, &embed)
+		// disable mentions by passing a zero'd allowmentions
+		var allowedMentions discordgo.MessageAllowedMentions
+		s.InteractionRespond(i.Interaction, &discordgo.InteractionResponse{
+			Type: discordgo.InteractionResponseChannelMessageWithSource,
+			Data: &discordgo.InteractionResponseData{
+				AllowedMentions: &allowedMentions,
+				Embeds:          embeds,
+			},
+		})
+	}
+}
@@ -0,0 +1,223 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+)
+
+// config is everything needed to start the bot. It is read from, in
+// increasing priority, the defaults below, a JSON config file, the
+// environment and the command line.
+type config struct {
+	// Token is the Discord bot token. If empty and MongoDB is used, the
+	// first document in the token collection is used, which is how older
+	// versions stored it.
+	Token  string      `json:"token"`
+	Store  string      `json:"store"`
+	SQLite string      `json:"sqlite"`
+	Mongo  mongoConfig `json:"mongo"`
+
+	// SyncMaxMembers is the largest guild in which a role's members are
+	// fixed as soon as its category changes.
+	SyncMaxMembers int `json:"sync_max_members"`
+	// ArchiveDays is how long a guild's categories are kept after the bot
+	// is removed from it, in case it's invited back.
+	ArchiveDays int `json:"archive_days"`
+
+	// Commands is "guild" to register the commands in each guild, or
+	// "global" to register them once for every guild.
+	Commands string `json:"commands"`
+	// DevGuilds limits guild mode to these guilds.
+	DevGuilds []string `json:"dev_guilds"`
+	// CleanupCommands deletes the commands registered by the other mode.
+	CleanupCommands bool `json:"cleanup_commands"`
+
+	// MigrateFrom isn't really configuration, it makes the bot copy data
+	// out of an old MongoDB database and exit.
+	MigrateFrom string `json:"-"`
+
+	// mongoSet is whether MongoDB was configured explicitly, by the config
+	// file, MONGO_URI or -mongo-uri, rather than just having defaults.
+	mongoSet bool
+}
+
+func defaultConfig() config {
+	return config{
+		Store:          "mongo",
+		SQLite:         "categories.db",
+		SyncMaxMembers: 10000,
+		ArchiveDays:    30,
+		Commands:       "guild",
+		Mongo: mongoConfig{
+			URI:        "mongodb://localhost:27017",
+			Database:   "test",
+			Roles:      "roles",
+			Categories: "categories",
+			Token:      "token",
+			Archive:    "archive",
+		},
+	}
+}
+
+// bindFlags registers a flag for every setting, using the current contents
+// of cfg as the defaults.
+func bindFlags(fs *flag.FlagSet, cfg *config, configPath *string) {
+	fs.StringVar(configPath, "config", *configPath, "JSON config file to read settings from")
+	fs.StringVar(&cfg.Token, "token", cfg.Token, "Discord bot token (or set DISCORD_TOKEN), read from the token collection if empty and MongoDB is used")
+	fs.StringVar(&cfg.Store, "store", cfg.Store, "where to keep categories: mongo, sqlite or memory (lost on exit)")
+	fs.StringVar(&cfg.SQLite, "sqlite", cfg.SQLite, "database file used by -store sqlite")
+	fs.StringVar(&cfg.Mongo.URI, "mongo-uri", cfg.Mongo.URI, "MongoDB connection string (or set MONGO_URI)")
+	fs.StringVar(&cfg.Mongo.Database, "mongo-db", cfg.Mongo.Database, "MongoDB database to use")
+	fs.StringVar(&cfg.Mongo.Roles, "roles-collection", cfg.Mongo.Roles, "MongoDB collection holding each guild's roles")
+	fs.StringVar(&cfg.Mongo.Categories, "categories-collection", cfg.Mongo.Categories, "MongoDB collection holding each guild's categories")
+	fs.StringVar(&cfg.Mongo.Token, "token-collection", cfg.Mongo.Token, "MongoDB collection holding the bot token")
+	fs.StringVar(&cfg.Mongo.Archive, "archive-collection", cfg.Mongo.Archive, "MongoDB collection holding the categories of servers the bot was removed from")
+	fs.IntVar(&cfg.ArchiveDays, "archive-days", cfg.ArchiveDays, "days to keep a server's categories after the bot is removed from it (0 deletes them right away)")
+	fs.IntVar(&cfg.SyncMaxMembers, "sync-max-members", cfg.SyncMaxMembers, "in servers with more members than this, changing a role's category doesn't update its members until /resync (0 means never)")
+	fs.StringVar(&cfg.Commands, "commands", cfg.Commands, "register commands per \"guild\" (changes show up instantly) or \"global\" (scales to many servers)")
+	fs.Var((*listFlag)(&cfg.DevGuilds), "dev-guilds", "comma separated guild IDs which are the only ones to get commands with -commands guild")
+	fs.BoolVar(&cfg.CleanupCommands, "cleanup-commands", cfg.CleanupCommands, "delete the commands registered by the other -commands mode, after switching")
+	fs.StringVar(&cfg.MigrateFrom, "migrate-from", cfg.MigrateFrom, "copy data from this MongoDB database (usually \"test\") into -mongo-db, then exit")
+}
+
+// listFlag is a flag holding a comma separated list.
+type listFlag []string
+
+func (l *listFlag) String() string {
+	return strings.Join(*l, ",")
+}
+
+func (l *listFlag) Set(value string) error {
+	*l = nil
+	for _, n := range strings.Split(value, ",") {
+		if n = strings.TrimSpace(n); n != "" {
+			*l = append(*l, n)
+		}
+	}
+	return nil
+}
+
+// loadConfig reads the configuration for the command line args. The flags
+// are parsed twice: once to find -config, and again with the file and
+// environment already applied so that flags given explicitly win.
+func loadConfig(name string, args []string) (cfg config, err error) {
+	var configPath string
+
+	first := flag.NewFlagSet(name, flag.ContinueOnError)
+	first.SetOutput(ioutil.Discard)
+	scratch := defaultConfig()
+	bindFlags(first, &scratch, &configPath)
+	// errors are reported by the second pass
+	first.Parse(args)
+
+	cfg = defaultConfig()
+	if configPath != "" {
+		var data []byte
+		data, err = ioutil.ReadFile(configPath)
+		if err != nil {
+			return
+		}
+		var file struct {
+			Mongo *json.RawMessage `json:"mongo"`
+		}
+		err = json.Unmarshal(data, &file)
+		if err == nil {
+			err = json.Unmarshal(data, &cfg)
+		}
+		if err != nil {
+			err = fmt.Errorf("reading %s: %v", configPath, err)
+			return
+		}
+		cfg.mongoSet = file.Mongo != nil
+	}
+
+	if token := os.Getenv("DISCORD_TOKEN"); token != "" {
+		cfg.Token = token
+	}
+	if uri := os.Getenv("MONGO_URI"); uri != "" {
+		cfg.Mongo.URI = uri
+		cfg.mongoSet = true
+	}
+
+	second := flag.NewFlagSet(name, flag.ExitOnError)
+	bindFlags(second, &cfg, &configPath)
+	err = second.Parse(args)
+	second.Visit(func(f *flag.Flag) {
+		if f.Name == "mongo-uri" {
+			cfg.mongoSet = true
+		}
+	})
+	return
+}
+
+// needsMongo reports whether the bot has to connect to MongoDB with cfg.
+// The token is only looked up in MongoDB if it's used anyway, or was set
+// up on purpose, so that the other stores fail with a clear error instead
+// of waiting for a server that isn't there.
+func (cfg config) needsMongo() bool {
+	return cfg.Store == "mongo" || cfg.MigrateFrom != "" || (cfg.Token == "" && cfg.mongoSet)
+}
+
+// validate returns every problem with cfg, so they can all be fixed at once.
+func (cfg config) validate() (errs []error) {
+	switch cfg.Store {
+	case "mongo", "memory":
+	case "sqlite":
+		if cfg.SQLite == "" {
+			errs = append(errs, errors.New("-sqlite must name a database file when using -store sqlite"))
+		}
+	default:
+		errs = append(errs, fmt.Errorf("unknown store %q, expected mongo, sqlite or memory", cfg.Store))
+	}
+
+	switch cfg.Commands {
+	case "guild":
+	case "global":
+		if len(cfg.DevGuilds) > 0 {
+			errs = append(errs, errors.New("-dev-guilds only works with -commands guild"))
+		}
+	default:
+		errs = append(errs, fmt.Errorf("unknown command mode %q, expected guild or global", cfg.Commands))
+	}
+
+	if cfg.SyncMaxMembers < 0 {
+		errs = append(errs, errors.New("-sync-max-members must not be negative"))
+	}
+	if cfg.ArchiveDays < 0 {
+		errs = append(errs, errors.New("-archive-days must not be negative"))
+	}
+
+	if cfg.Token == "" && !cfg.needsMongo() {
+		errs = append(errs, errors.New("no token: set DISCORD_TOKEN or -token"))
+	}
+	if strings.HasPrefix(cfg.Token, "Bot ") {
+		errs = append(errs, errors.New("the token should not start with \"Bot \", only give the token itself"))
+	}
+	if strings.TrimSpace(cfg.Token) != cfg.Token {
+		errs = append(errs, errors.New("the token has leading or trailing whitespace"))
+	}
+
+	if cfg.needsMongo() {
+		if cfg.Mongo.URI == "" {
+			errs = append(errs, errors.New("MongoDB is needed but no URI is set, use -mongo-uri or MONGO_URI"))
+		} else if !strings.HasPrefix(cfg.Mongo.URI, "mongodb://") && !strings.HasPrefix(cfg.Mongo.URI, "mongodb+srv://") {
+			errs = append(errs, fmt.Errorf("MongoDB URI %q should start with mongodb:// or mongodb+srv://", cfg.Mongo.URI))
+		}
+		if cfg.Mongo.Database == "" {
+			errs = append(errs, errors.New("-mongo-db must not be empty"))
+		}
+		if cfg.Mongo.Roles == "" || cfg.Mongo.Categories == "" || cfg.Mongo.Token == "" || cfg.Mongo.Archive == "" {
+			errs = append(errs, errors.New("MongoDB collection names must not be empty"))
+		}
+		if cfg.MigrateFrom != "" && cfg.MigrateFrom == cfg.Mongo.Database &&
+			cfg.Mongo.Roles == "roles" && cfg.Mongo.Categories == "categories" && cfg.Mongo.Token == "token" {
+			errs = append(errs, fmt.Errorf("-migrate-from %s would copy %s onto itself, set -mongo-db to the new database", cfg.MigrateFrom, cfg.Mongo.Database))
+		}
+	}
+	return
+}
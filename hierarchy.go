@@ -0,0 +1,185 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+var errNoManageRoles = errors.New("I don't have the Manage Roles permission! Give it to one of my roles in Server Settings > Roles.")
+
+// rolePermissions adds up the permissions of @everyone and the given roles.
+func rolePermissions(guild *discordgo.Guild, roles []string) (perms int64) {
+	for _, role := range guild.Roles {
+		if role.ID == guild.ID {
+			perms |= role.Permissions
+			continue
+		}
+		for _, roleID := range roles {
+			if role.ID == roleID {
+				perms |= role.Permissions
+				break
+			}
+		}
+	}
+	if perms&discordgo.PermissionAdministrator == discordgo.PermissionAdministrator {
+		perms = discordgo.PermissionAll
+	}
+	return
+}
+
+// memberPermissions computes a member's guild wide permissions. Owners and
+// administrators can do anything.
+func memberPermissions(guild *discordgo.Guild, member *discordgo.Member) int64 {
+	if member.User != nil && member.User.ID == guild.OwnerID {
+		return discordgo.PermissionAll
+	}
+	return rolePermissions(guild, member.Roles)
+}
+
+// highestRole returns the member's role with the highest position, or nil if
+// they only have @everyone.
+func highestRole(guild *discordgo.Guild, member *discordgo.Member) (top *discordgo.Role) {
+	for _, role := range guild.Roles {
+		for _, roleID := range member.Roles {
+			if role.ID == roleID && (top == nil || role.Position > top.Position) {
+				top = role
+			}
+		}
+	}
+	return
+}
+
+func findRole(guild *discordgo.Guild, roleID string) *discordgo.Role {
+	for _, role := range guild.Roles {
+		if role.ID == roleID {
+			return role
+		}
+	}
+	return nil
+}
+
+// botMember returns the bot's own member in a guild.
+func botMember(s *discordgo.Session, gid string) (member *discordgo.Member, err error) {
+	member, err = s.State.Member(gid, s.State.User.ID)
+	if err != nil {
+		member, err = s.GuildMember(gid, s.State.User.ID)
+	}
+	return
+}
+
+// checkAssignable explains why the bot can't give role to members, or
+// returns nil if it can. Discord only lets the bot manage roles which are
+// below its own highest role. If invoker isn't nil, the role also has to be
+// one the invoker could manage themselves, see checkInvoker.
+func checkAssignable(s *discordgo.Session, gid string, roleID string, invoker *discordgo.Member) error {
+	guild, err := s.State.Guild(gid)
+	if err != nil {
+		return err
+	}
+	bot, err := botMember(s, gid)
+	if err != nil {
+		return err
+	}
+
+	role := findRole(guild, roleID)
+	if role == nil {
+		return errors.New("That role doesn't exist anymore!")
+	}
+	if role.ID == guild.ID {
+		return errors.New("@everyone can't be a category!")
+	}
+	if role.Managed {
+		return fmt.Errorf("%q is managed by an integration, so I can't give it to anyone.", role.Name)
+	}
+
+	if memberPermissions(guild, bot)&discordgo.PermissionManageRoles != discordgo.PermissionManageRoles {
+		return errNoManageRoles
+	}
+
+	top := highestRole(guild, bot)
+	if top == nil || top.Position <= role.Position {
+		name := "my role"
+		if top != nil {
+			name = fmt.Sprintf("my highest role %q", top.Name)
+		}
+		return fmt.Errorf("%q is not below %s, so I can't give it to anyone. Drag %s above it in Server Settings > Roles.", role.Name, name, name)
+	}
+	if invoker != nil {
+		return checkInvoker(s, gid, roleID, invoker)
+	}
+	return nil
+}
+
+// checkInvoker explains why the member running a command may not manage
+// role through the bot, or returns nil if they may. Like Discord itself, it
+// only lets members manage roles below their own highest role, unless they
+// own the server. Otherwise anyone allowed to use the commands could have
+// the bot hand out roles above them.
+func checkInvoker(s *discordgo.Session, gid string, roleID string, invoker *discordgo.Member) error {
+	guild, err := s.State.Guild(gid)
+	if err != nil {
+		return err
+	}
+	if invoker.User != nil && invoker.User.ID == guild.OwnerID {
+		return nil
+	}
+
+	// nobody can be given a deleted role, so there's nothing to protect
+	role := findRole(guild, roleID)
+	if role == nil {
+		return nil
+	}
+	top := highestRole(guild, invoker)
+	if top == nil || top.Position <= role.Position {
+		return fmt.Errorf("%q is not below your highest role, so you can't manage it.", role.Name)
+	}
+	return nil
+}
+
+// checkInvokerRoles is checkInvoker for several roles, and explains the
+// first one the invoker may not manage.
+func checkInvokerRoles(s *discordgo.Session, gid string, roles []string, invoker *discordgo.Member) error {
+	for _, role := range roles {
+		if err := checkInvoker(s, gid, role, invoker); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// brokenMappings lists every category and role of a guild which the bot
+// can't currently enforce, with the reason why.
+func brokenMappings(s *discordgo.Session, store CategoryStore, gid string) (broken []string, err error) {
+	gCat, err := store.Categories(gid)
+	if err != nil {
+		return
+	}
+	gRoles, err := store.Roles(gid)
+	if err != nil {
+		return
+	}
+	guild, err := s.State.Guild(gid)
+	if err != nil {
+		return
+	}
+
+	for _, k := range gCat {
+		// only the bot's own limits, whoever runs /diagnose
+		err := checkAssignable(s, gid, k.Role, nil)
+		if err == errNoManageRoles {
+			// nothing works, no point in listing every category
+			return []string{err.Error()}, nil
+		}
+		if err != nil {
+			broken = append(broken, "Category <@&"+k.Role+">: "+err.Error())
+		}
+	}
+	for _, k := range gRoles {
+		if findRole(guild, k.Role) == nil {
+			broken = append(broken, "Role "+k.Role+" in <@&"+k.Category+"> doesn't exist anymore!")
+		}
+	}
+	return
+}
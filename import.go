@@ -0,0 +1,338 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+// defaultDividerPattern matches the divider roles made by the role
+// generator, like "+ House Roles +".
+const defaultDividerPattern = `^\+.*\+$`
+
+// importTimeout is how long a preview can be confirmed. Interaction tokens
+// expire after 15 minutes, so the preview couldn't be updated after that.
+const importTimeout = 15 * time.Minute
+
+// pendingImport is an import previewed by /category import-from-dividers
+// which is waiting for its user to confirm it.
+type pendingImport struct {
+	user    string
+	gid     string
+	plan    []catRoles
+	expires time.Time
+}
+
+var (
+	pendingMu sync.Mutex
+	// pending imports by the ID of the interaction which previewed them
+	pending = make(map[string]*pendingImport)
+)
+
+// planDividerImport finds the divider roles matching pattern and every role
+// below each of them, down to the next divider. Categories and roles which
+// are already set up the same way are left out, and so are roles managed by
+// integrations. Dividers the bot can't give out, or which invoker couldn't
+// manage themselves, are returned in skipped.
+func planDividerImport(s *discordgo.Session, store CategoryStore, gid string, pattern *regexp.Regexp, invoker *discordgo.Member) (plan []catRoles, skipped []string, err error) {
+	guild, err := s.State.Guild(gid)
+	if err != nil {
+		return
+	}
+	gCat, err := store.Categories(gid)
+	if err != nil {
+		return
+	}
+	gRoles, err := store.Roles(gid)
+	if err != nil {
+		return
+	}
+
+	isCategory := make(map[string]bool)
+	for _, k := range gCat {
+		isCategory[k.Role] = true
+	}
+	mapped := make(map[string]bool)
+	for _, k := range gRoles {
+		mapped[k.Role] = true
+	}
+
+	// highest role first, like in Server Settings > Roles
+	roles := append([]*discordgo.Role(nil), guild.Roles...)
+	sort.SliceStable(roles, func(a, b int) bool {
+		return roles[a].Position > roles[b].Position
+	})
+
+	current := -1
+	for _, role := range roles {
+		if role.ID == guild.ID {
+			continue
+		}
+		if pattern.MatchString(role.Name) {
+			current = -1
+			if err := checkAssignable(s, gid, role.ID, invoker); err != nil {
+				skipped = append(skipped, "<@&"+role.ID+">: "+err.Error())
+				continue
+			}
+			plan = append(plan, catRoles{Category: role.ID})
+			current = len(plan) - 1
+			continue
+		}
+		if current < 0 || role.Managed || isCategory[role.ID] || mapped[role.ID] {
+			continue
+		}
+		plan[current].Roles = append(plan[current].Roles, role.ID)
+	}
+
+	// drop the dividers which wouldn't change anything
+	var changed []catRoles
+	for _, n := range plan {
+		if !isCategory[n.Category] || len(n.Roles) > 0 {
+			changed = append(changed, n)
+		}
+	}
+	plan = changed
+	return
+}
+
+// categoryImport previews which categories /category import-from-dividers
+// would set up, with buttons to confirm or cancel it.
+func categoryImport(s *discordgo.Session, i *discordgo.InteractionCreate, store CategoryStore, expr string) {
+	var msgformat string
+	mr, err := checkAccess(i.Member, i.GuildID, s, store, false)
+	if err != nil || mr == false {
+		if err != nil {
+			msgformat = err.Error()
+		} else {
+			msgformat = "User does not have manage roles permission or a manager role!"
+		}
+		s.InteractionRespond(i.Interaction, &discordgo.InteractionResponse{
+			Type: discordgo.InteractionResponseChannelMessageWithSource,
+			Data: &discordgo.InteractionResponseData{
+				Content: msgformat,
+			},
+		})
+		return
+	}
+
+	if expr == "" {
+		expr = defaultDividerPattern
+	}
+	pattern, err := regexp.Compile(expr)
+	var plan []catRoles
+	var skipped []string
+	if err == nil {
+		plan, skipped, err = planDividerImport(s, store, i.GuildID, pattern, i.Member)
+	}
+	if err == nil && len(plan) == 0 {
+		err = fmt.Errorf("Found no divider roles matching `%s` with anything to import.", expr)
+	}
+	if err != nil {
+		// the message can contain the pattern, which mustn't be taken as
+		// a format string
+		s.InteractionRespond(i.Interaction, &discordgo.InteractionResponse{
+			Type: discordgo.InteractionResponseChannelMessageWithSource,
+			Data: &discordgo.InteractionResponseData{
+				Content: err.Error(),
+			},
+		})
+		return
+	}
+
+	pendingMu.Lock()
+	for key, p := range pending {
+		if p.expires.Before(time.Now()) {
+			delete(pending, key)
+		}
+	}
+	pending[i.ID] = &pendingImport{
+		user:    i.Member.User.ID,
+		gid:     i.GuildID,
+		plan:    plan,
+		expires: time.Now().Add(importTimeout),
+	}
+	pendingMu.Unlock()
+
+	var embed discordgo.MessageEmbed
+	embed.Color = 0xCC00CC
+	embed.Title = "Import preview"
+	for _, n := range plan {
+		embed.Description += "<@&" + n.Category + ">\n"
+		for _, k := range n.Roles {
+			embed.Description += "<@&" + k + "> "
+		}
+		embed.Description += "\n"
+	}
+	if len(skipped) > 0 {
+		embed.Description += "\nSkipped:\n" + strings.Join(skipped, "\n")
+	}
+	// embed descriptions are limited to 4096 characters. Cutting at a space
+	// or line break keeps mentions and multi-byte role names whole, Discord
+	// rejects the preview if it isn't valid UTF-8.
+	if len(embed.Description) > 4000 {
+		cut := strings.LastIndexAny(embed.Description[:4000], " \n")
+		embed.Description = embed.Description[:cut+1] + "\n..."
+	}
+
+	// disable mentions by passing a zero'd allowmentions
+	var allowedMentions discordgo.MessageAllowedMentions
+	err = s.InteractionRespond(i.Interaction, &discordgo.InteractionResponse{
+		Type: discordgo.InteractionResponseChannelMessageWithSource,
+		Data: &discordgo.InteractionResponseData{
+			AllowedMentions: &allowedMentions,
+			Content:         "This is what importing the dividers would do. Nothing changes until you confirm.",
+			Embeds:          []*discordgo.MessageEmbed{&embed},
+			Components: []discordgo.MessageComponent{
+				discordgo.ActionsRow{
+					Components: []discordgo.MessageComponent{
+						discordgo.Button{
+							Label:    "Confirm",
+							Style:    discordgo.SuccessButton,
+							CustomID: "import-confirm:" + i.ID,
+						},
+						discordgo.Button{
+							Label:    "Cancel",
+							Style:    discordgo.SecondaryButton,
+							CustomID: "import-cancel:" + i.ID,
+						},
+					},
+				},
+			},
+		},
+	})
+	if err != nil {
+		fmt.Println(err)
+	}
+}
+
+// takeImport removes a pending import so that it can only be answered once.
+// Only the user who previewed it may do that.
+func takeImport(i *discordgo.InteractionCreate, key string) (*pendingImport, error) {
+	pendingMu.Lock()
+	defer pendingMu.Unlock()
+
+	p, ok := pending[key]
+	if !ok || p.expires.Before(time.Now()) || p.gid != i.GuildID {
+		delete(pending, key)
+		return nil, errors.New("This import expired, run /category import-from-dividers again.")
+	}
+	if p.user != i.Member.User.ID {
+		return nil, fmt.Errorf("Only <@%s> can answer this import.", p.user)
+	}
+	delete(pending, key)
+	return p, nil
+}
+
+// importConfirm runs a previewed import.
+func importConfirm(s *discordgo.Session, i *discordgo.InteractionCreate, store CategoryStore, key string) {
+	// disable mentions by passing a zero'd allowmentions
+	var allowedMentions discordgo.MessageAllowedMentions
+
+	p, err := takeImport(i, key)
+	if err == nil {
+		// the user's access may have changed since the preview
+		var mr bool
+		mr, err = checkAccess(i.Member, i.GuildID, s, store, false)
+		if err == nil && mr == false {
+			err = errors.New("User does not have manage roles permission or a manager role!")
+		}
+	}
+	if err != nil {
+		s.InteractionRespond(i.Interaction, &discordgo.InteractionResponse{
+			Type: discordgo.InteractionResponseChannelMessageWithSource,
+			Data: &discordgo.InteractionResponseData{
+				AllowedMentions: &allowedMentions,
+				Content:         err.Error(),
+				Flags:           discordgo.MessageFlagsEphemeral,
+			},
+		})
+		return
+	}
+
+	var added []string
+	var b strings.Builder
+	for _, n := range p.plan {
+		// roles may have been moved since the preview
+		err := checkAssignable(s, i.GuildID, n.Category, i.Member)
+		if err != nil {
+			fmt.Fprintf(&b, "<@&%s>: %s\n", n.Category, err.Error())
+			continue
+		}
+		err = store.AddCategory(n.Category, i.GuildID)
+		if err != nil && err != errAlreadyCategory {
+			fmt.Fprintf(&b, "<@&%s>: %s\n", n.Category, err.Error())
+			continue
+		}
+		if len(n.Roles) == 0 {
+			fmt.Fprintf(&b, "<@&%s>: category created\n", n.Category)
+			continue
+		}
+		failed, err := store.SetCategories(n.Category, n.Roles, i.GuildID)
+		if err != nil {
+			fmt.Fprintf(&b, "<@&%s>: %s\n", n.Category, err.Error())
+			continue
+		}
+		fmt.Fprintf(&b, "<@&%s>: %d roles added\n", n.Category, len(n.Roles)-len(failed))
+		for _, role := range n.Roles {
+			if err, ok := failed[role]; ok {
+				fmt.Fprintf(&b, "- <@&%s>: %s\n", role, err.Error())
+			} else {
+				added = append(added, role)
+			}
+		}
+	}
+
+	err = s.InteractionRespond(i.Interaction, &discordgo.InteractionResponse{
+		Type: discordgo.InteractionResponseUpdateMessage,
+		Data: &discordgo.InteractionResponseData{
+			AllowedMentions: &allowedMentions,
+			Content:         "Imported the dividers:\n" + b.String(),
+			Embeds:          []*discordgo.MessageEmbed{},
+			Components:      []discordgo.MessageComponent{},
+		},
+	})
+	if err != nil {
+		fmt.Println(err)
+	}
+	if len(added) > 0 {
+		positionAfterChange(s, i, store)
+		applyMappingChange(s, i, store, added...)
+	}
+}
+
+// importCancel throws a previewed import away.
+func importCancel(s *discordgo.Session, i *discordgo.InteractionCreate, store CategoryStore, key string) {
+	// disable mentions by passing a zero'd allowmentions
+	var allowedMentions discordgo.MessageAllowedMentions
+
+	_, err := takeImport(i, key)
+	if err != nil {
+		s.InteractionRespond(i.Interaction, &discordgo.InteractionResponse{
+			Type: discordgo.InteractionResponseChannelMessageWithSource,
+			Data: &discordgo.InteractionResponseData{
+				AllowedMentions: &allowedMentions,
+				Content:         err.Error(),
+				Flags:           discordgo.MessageFlagsEphemeral,
+			},
+		})
+		return
+	}
+
+	err = s.InteractionRespond(i.Interaction, &discordgo.InteractionResponse{
+		Type: discordgo.InteractionResponseUpdateMessage,
+		Data: &discordgo.InteractionResponseData{
+			Content:    "Import cancelled, nothing was changed.",
+			Embeds:     []*discordgo.MessageEmbed{},
+			Components: []discordgo.MessageComponent{},
+		},
+	})
+	if err != nil {
+		fmt.Println(err)
+	}
+}
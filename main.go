@@ -2,11 +2,11 @@ package main
 
 import (
 	"context"
-	"errors"
 	"fmt"
 	"log"
 	"os"
 	"os/signal"
+	"strings"
 	"syscall"
 	"time"
 
@@ -18,10 +18,213 @@ import (
 )
 
 var (
+	// Discord hides the commands from members without manage roles,
+	// checkManageRoles still runs in case a server changes that
+	defaultMemberPermissions int64 = discordgo.PermissionManageRoles
+	// every command needs a server, and global commands would otherwise
+	// also work in DMs with the bot. Guild commands leave it out, see
+	// registerCommands
+	guildOnly = []discordgo.InteractionContextType{discordgo.InteractionContextGuild}
+
+	// the range of /category set-threshold
+	minThreshold float64 = 1
+	maxThreshold float64 = 250
+
 	commands =  []*discordgo.ApplicationCommand{
+		{
+			Name: "category",
+			Description: "Commands which manage categories",
+			DefaultMemberPermissions: &defaultMemberPermissions,
+			Contexts: &guildOnly,
+			Options: []*discordgo.ApplicationCommandOption{
+				{
+					Type: discordgo.ApplicationCommandOptionSubCommand,
+					Name: "create",
+					Description: "Designates a role as a category",
+					Options: []*discordgo.ApplicationCommandOption{
+						{
+							Type: discordgo.ApplicationCommandOptionRole,
+							Name: "category",
+							Description: "Role to become a category",
+							Required: true,
+						},
+					},
+				},
+				{
+					Type: discordgo.ApplicationCommandOptionSubCommand,
+					Name: "delete",
+					Description: "Removes a role from the category list",
+					Options: []*discordgo.ApplicationCommandOption{
+						{
+							Type: discordgo.ApplicationCommandOptionString,
+							Name: "category",
+							Description: "Category to remove",
+							Required: true,
+							Autocomplete: true,
+						},
+					},
+				},
+				{
+					Type: discordgo.ApplicationCommandOptionSubCommand,
+					Name: "add-role",
+					Description: "Assigns a role to a category",
+					Options: []*discordgo.ApplicationCommandOption{
+						{
+							Type: discordgo.ApplicationCommandOptionRole,
+							Name: "role",
+							Description: "Role to assign to category",
+							Required: true,
+						},
+						{
+							Type: discordgo.ApplicationCommandOptionRole,
+							Name: "category",
+							Description: "Category to assign role to",
+							Required: true,
+						},
+					},
+				},
+				{
+					Type: discordgo.ApplicationCommandOptionSubCommand,
+					Name: "add-roles",
+					Description: "Assigns up to 10 roles to a category at once",
+					Options: append([]*discordgo.ApplicationCommandOption{
+						{
+							Type: discordgo.ApplicationCommandOptionRole,
+							Name: "category",
+							Description: "Category to assign the roles to",
+							Required: true,
+						},
+					}, bulkRoleOptions()...),
+				},
+				{
+					Type: discordgo.ApplicationCommandOptionSubCommand,
+					Name: "move-role",
+					Description: "Changes the category a role is assigned to",
+					Options: []*discordgo.ApplicationCommandOption{
+						{
+							Type: discordgo.ApplicationCommandOptionString,
+							Name: "role",
+							Description: "Role to change",
+							Required: true,
+							Autocomplete: true,
+						},
+						{
+							Type: discordgo.ApplicationCommandOptionString,
+							Name: "category",
+							Description: "Category to change to",
+							Required: true,
+							Autocomplete: true,
+						},
+					},
+				},
+				{
+					Type: discordgo.ApplicationCommandOptionSubCommand,
+					Name: "remove-role",
+					Description: "Removes a role from a category",
+					Options: []*discordgo.ApplicationCommandOption{
+						{
+							Type: discordgo.ApplicationCommandOptionString,
+							Name: "role",
+							Description: "Role to change",
+							Required: true,
+							Autocomplete: true,
+						},
+						{
+							Type: discordgo.ApplicationCommandOptionString,
+							Name: "category",
+							Description: "Category to remove it from, every category it is in if not given",
+							Required: false,
+							Autocomplete: true,
+						},
+					},
+				},
+				{
+					Type: discordgo.ApplicationCommandOptionSubCommand,
+					Name: "list",
+					Description: "Lists every category and its roles",
+				},
+				{
+					Type: discordgo.ApplicationCommandOptionSubCommand,
+					Name: "set-exclusive",
+					Description: "Changes whether members may only have one role from a category",
+					Options: []*discordgo.ApplicationCommandOption{
+						{
+							Type: discordgo.ApplicationCommandOptionString,
+							Name: "category",
+							Description: "Category to change",
+							Required: true,
+							Autocomplete: true,
+						},
+						{
+							Type: discordgo.ApplicationCommandOptionBoolean,
+							Name: "exclusive",
+							Description: "Whether members may only have one of its roles",
+							Required: true,
+						},
+					},
+				},
+				{
+					Type: discordgo.ApplicationCommandOptionSubCommand,
+					Name: "set-threshold",
+					Description: "Changes how many roles from a category members need to get it",
+					Options: []*discordgo.ApplicationCommandOption{
+						{
+							Type: discordgo.ApplicationCommandOptionString,
+							Name: "category",
+							Description: "Category to change",
+							Required: true,
+							Autocomplete: true,
+						},
+						{
+							Type: discordgo.ApplicationCommandOptionInteger,
+							Name: "count",
+							Description: "How many of its roles members need, 1 by default",
+							Required: true,
+							MinValue: &minThreshold,
+							MaxValue: maxThreshold,
+						},
+					},
+				},
+				{
+					Type: discordgo.ApplicationCommandOptionSubCommand,
+					Name: "panel",
+					Description: "Posts a menu here which lets members pick roles from a category",
+					Options: []*discordgo.ApplicationCommandOption{
+						{
+							Type: discordgo.ApplicationCommandOptionString,
+							Name: "category",
+							Description: "Category to pick roles from",
+							Required: true,
+							Autocomplete: true,
+						},
+					},
+				},
+				{
+					Type: discordgo.ApplicationCommandOptionSubCommand,
+					Name: "reorder",
+					Description: "Moves every role directly below its category",
+				},
+				{
+					Type: discordgo.ApplicationCommandOptionSubCommand,
+					Name: "import-from-dividers",
+					Description: "Turns divider roles into categories of the roles below them",
+					Options: []*discordgo.ApplicationCommandOption{
+						{
+							Type: discordgo.ApplicationCommandOptionString,
+							Name: "pattern",
+							Description: "Regular expression matching the dividers' names, defaults to ^\\+.*\\+$",
+							Required: false,
+						},
+					},
+				},
+			},
+		},
+		// the old top level commands, kept around until the next release
 		{
 			Name: "makecategory",
-			Description: "Command which designates a role as a category",
+			Description: "(Deprecated, use /category create) Command which designates a role as a category",
+			DefaultMemberPermissions: &defaultMemberPermissions,
+			Contexts: &guildOnly,
 			Options: []*discordgo.ApplicationCommandOption{
 				{
 					Type: discordgo.ApplicationCommandOptionRole,
@@ -33,7 +236,9 @@ var (
 		},
 		{
 			Name: "setcategory",
-			Description: "Command which assigns roles to a category",
+			Description: "(Deprecated, use /category add-role) Command which assigns roles to a category",
+			DefaultMemberPermissions: &defaultMemberPermissions,
+			Contexts: &guildOnly,
 			Options: []*discordgo.ApplicationCommandOption{
 				{
 					Type: discordgo.ApplicationCommandOptionRole,
@@ -51,257 +256,343 @@ var (
 		},
 		{
 			Name: "removecategory",
-			Description: "Command which removes a role from the category list",
+			Description: "(Deprecated, use /category delete) Command which removes a role from the category list",
+			DefaultMemberPermissions: &defaultMemberPermissions,
+			Contexts: &guildOnly,
 			Options: []*discordgo.ApplicationCommandOption{
 				{
-					Type: discordgo.ApplicationCommandOptionRole,
+					Type: discordgo.ApplicationCommandOptionString,
 					Name: "category",
 					Description: "Category to remove",
 					Required: true,
+					Autocomplete: true,
 				},
 			},
 		},
 		{
 			Name: "updatecategory",
-			Description: "Command which changes the category a role is assigned to",
+			Description: "(Deprecated, use /category move-role) Command which changes the category a role is assigned to",
+			DefaultMemberPermissions: &defaultMemberPermissions,
+			Contexts: &guildOnly,
 			Options: []*discordgo.ApplicationCommandOption{
 				{
-					Type: discordgo.ApplicationCommandOptionRole,
+					Type: discordgo.ApplicationCommandOptionString,
 					Name: "role",
 					Description: "Role to change",
 					Required: true,
+					Autocomplete: true,
 				},
 				{
-					Type: discordgo.ApplicationCommandOptionRole,
+					Type: discordgo.ApplicationCommandOptionString,
 					Name: "category",
 					Description: "Category to change to",
 					Required: true,
+					Autocomplete: true,
 				},
 			},
 		},
 		{
 			Name: "unsetcategory",
-			Description: "Command which removes a role's category",
+			Description: "(Deprecated, use /category remove-role) Command which removes a role's category",
+			DefaultMemberPermissions: &defaultMemberPermissions,
+			Contexts: &guildOnly,
 			Options: []*discordgo.ApplicationCommandOption{
 				{
-					Type: discordgo.ApplicationCommandOptionRole,
+					Type: discordgo.ApplicationCommandOptionString,
 					Name: "role",
 					Description: "Role to change",
 					Required: true,
+					Autocomplete: true,
 				},
 			},
 		},
 		{
 			Name: "listall",
-			Description: "Lists every category and its roles",
+			Description: "(Deprecated, use /category list) Lists every category and its roles",
+			DefaultMemberPermissions: &defaultMemberPermissions,
+			Contexts: &guildOnly,
+		},
+		{
+			Name: "diagnose",
+			Description: "Lists every category and role the bot currently can't handle",
+			DefaultMemberPermissions: &defaultMemberPermissions,
+			Contexts: &guildOnly,
+		},
+		{
+			Name: "config",
+			Description: "Command which changes how the bot works in this server",
+			DefaultMemberPermissions: &defaultMemberPermissions,
+			Contexts: &guildOnly,
+			Options: []*discordgo.ApplicationCommandOption{
+				{
+					Type: discordgo.ApplicationCommandOptionSubCommandGroup,
+					Name: "managers",
+					Description: "Roles which may use the commands without the manage roles permission",
+					Options: []*discordgo.ApplicationCommandOption{
+						{
+							Type: discordgo.ApplicationCommandOptionSubCommand,
+							Name: "add",
+							Description: "Lets a role use the commands",
+							Options: []*discordgo.ApplicationCommandOption{
+								{
+									Type: discordgo.ApplicationCommandOptionRole,
+									Name: "role",
+									Description: "Role to allow",
+									Required: true,
+								},
+								{
+									Type: discordgo.ApplicationCommandOptionBoolean,
+									Name: "read-only",
+									Description: "Only allow /category list",
+									Required: false,
+								},
+							},
+						},
+						{
+							Type: discordgo.ApplicationCommandOptionSubCommand,
+							Name: "remove",
+							Description: "Stops a role from using the commands",
+							Options: []*discordgo.ApplicationCommandOption{
+								{
+									Type: discordgo.ApplicationCommandOptionRole,
+									Name: "role",
+									Description: "Role to disallow",
+									Required: true,
+								},
+							},
+						},
+						{
+							Type: discordgo.ApplicationCommandOptionSubCommand,
+							Name: "list",
+							Description: "Lists every manager role",
+						},
+					},
+				},
+				{
+					Type: discordgo.ApplicationCommandOptionSubCommand,
+					Name: "auto-position",
+					Description: "Moves roles below their category whenever their category changes",
+					Options: []*discordgo.ApplicationCommandOption{
+						{
+							Type: discordgo.ApplicationCommandOptionBoolean,
+							Name: "enabled",
+							Description: "Whether to move roles",
+							Required: true,
+						},
+					},
+				},
+			},
+		},
+		{
+			Name: "resync",
+			Description: "Command which fixes the categories of a member, or of everyone",
+			DefaultMemberPermissions: &defaultMemberPermissions,
+			Contexts: &guildOnly,
+			Options: []*discordgo.ApplicationCommandOption{
+				{
+					Type: discordgo.ApplicationCommandOptionUser,
+					Name: "member",
+					Description: "Member to fix, leave empty to fix the whole server",
+					Required: false,
+				},
+			},
 		},
 	}
-	commandHandlers = map[string]func(s *discordgo.Session, i *discordgo.InteractionCreate, db *mongo.Client) {
-		"makecategory": func(s *discordgo.Session, i *discordgo.InteractionCreate, db *mongo.Client) {
-			margs := []interface{}{
-				i.Data.Options[0].RoleValue(nil, "").ID,
+	commandHandlers = map[string]func(s *discordgo.Session, i *discordgo.InteractionCreate, store CategoryStore) {
+		"category": func(s *discordgo.Session, i *discordgo.InteractionCreate, store CategoryStore) {
+			sub := i.ApplicationCommandData().Options[0]
+			opts := optionMap(sub.Options)
+			switch sub.Name {
+			case "create":
+				categoryCreate(s, i, store, opts["category"].RoleValue(nil, "").ID)
+			case "delete":
+				categoryDelete(s, i, store, resolveRole(s, i.GuildID, opts["category"].StringValue()))
+			case "add-role":
+				categoryAddRole(s, i, store, opts["category"].RoleValue(nil, "").ID, opts["role"].RoleValue(nil, "").ID)
+			case "add-roles":
+				categoryAddRoles(s, i, store, opts["category"].RoleValue(nil, "").ID, bulkRoles(opts))
+			case "move-role":
+				categoryMoveRole(s, i, store, resolveRole(s, i.GuildID, opts["category"].StringValue()), resolveRole(s, i.GuildID, opts["role"].StringValue()))
+			case "remove-role":
+				var cat string
+				if o, ok := opts["category"]; ok {
+					cat = resolveRole(s, i.GuildID, o.StringValue())
+				}
+				categoryRemoveRole(s, i, store, cat, resolveRole(s, i.GuildID, opts["role"].StringValue()))
+			case "list":
+				categoryList(s, i, store)
+			case "set-exclusive":
+				categorySetExclusive(s, i, store, resolveRole(s, i.GuildID, opts["category"].StringValue()), opts["exclusive"].BoolValue())
+			case "set-threshold":
+				categorySetThreshold(s, i, store, resolveRole(s, i.GuildID, opts["category"].StringValue()), int(opts["count"].IntValue()))
+			case "panel":
+				categoryPanel(s, i, store, resolveRole(s, i.GuildID, opts["category"].StringValue()))
+			case "reorder":
+				categoryReorder(s, i, store)
+			case "import-from-dividers":
+				var pattern string
+				if o, ok := opts["pattern"]; ok {
+					pattern = o.StringValue()
+				}
+				categoryImport(s, i, store, pattern)
 			}
+		},
+		"makecategory": func(s *discordgo.Session, i *discordgo.InteractionCreate, store CategoryStore) {
+			categoryCreate(s, i, store, i.ApplicationCommandData().Options[0].RoleValue(nil, "").ID)
+		},
+		"setcategory": func(s *discordgo.Session, i *discordgo.InteractionCreate, store CategoryStore) {
+			categoryAddRole(s, i, store, i.ApplicationCommandData().Options[0].RoleValue(nil, "").ID, i.ApplicationCommandData().Options[1].RoleValue(nil, "").ID)
+		},
+		"removecategory": func(s *discordgo.Session, i *discordgo.InteractionCreate, store CategoryStore) {
+			categoryDelete(s, i, store, resolveRole(s, i.GuildID, i.ApplicationCommandData().Options[0].StringValue()))
+		},
+		"updatecategory": func(s *discordgo.Session, i *discordgo.InteractionCreate, store CategoryStore) {
+			categoryMoveRole(s, i, store, resolveRole(s, i.GuildID, i.ApplicationCommandData().Options[1].StringValue()), resolveRole(s, i.GuildID, i.ApplicationCommandData().Options[0].StringValue()))
+		},
+		"unsetcategory": func(s *discordgo.Session, i *discordgo.InteractionCreate, store CategoryStore) {
+			categoryRemoveRole(s, i, store, "", resolveRole(s, i.GuildID, i.ApplicationCommandData().Options[0].StringValue()))
+		},
+		"listall": func(s *discordgo.Session, i *discordgo.InteractionCreate, store CategoryStore) {
+			categoryList(s, i, store)
+		},
+		"resync": func(s *discordgo.Session, i *discordgo.InteractionCreate, store CategoryStore) {
 			var msgformat string
-			mr, err := checkManageRoles(i.Member, i.ChannelID, s)
+			mr, err := checkAccess(i.Member, i.GuildID, s, store, false)
 			if err != nil || mr == false {
 				if err != nil {
 					msgformat = err.Error()
 				} else {
-					msgformat = "User does not have manage roles permission!"
+					msgformat = "User does not have manage roles permission or a manager role!"
 				}
 				s.InteractionRespond(i.Interaction, &discordgo.InteractionResponse{
 					Type: discordgo.InteractionResponseChannelMessageWithSource,
-					Data: &discordgo.InteractionApplicationCommandResponseData{
-						Content: fmt.Sprintf(
-							msgformat,
-						),
+					Data: &discordgo.InteractionResponseData{
+						Content: msgformat,
 					},
 				})
 				return
 			}
-			err = addCategory(i.Data.Options[0].RoleValue(nil, "").ID, i.GuildID, db)
-			if err != nil {
-				msgformat = err.Error()
-				s.InteractionRespond(i.Interaction, &discordgo.InteractionResponse{
-					Type: discordgo.InteractionResponseChannelMessageWithSource,
-					Data: &discordgo.InteractionApplicationCommandResponseData{
-						Content: fmt.Sprintf(
-							msgformat,
-						),
-					},
-				})
-				return
-			} else {
-				msgformat = `role <@&%s> is now a category!`
-				// disable mentions by passing a zero'd allowmentions
-				var allowedMentions discordgo.MessageAllowedMentions
-				s.InteractionRespond(i.Interaction, &discordgo.InteractionResponse{
-					Type: discordgo.InteractionResponseChannelMessageWithSource,
-					Data: &discordgo.InteractionApplicationCommandResponseData{
-						AllowedMentions: &allowedMentions,
-						Content: fmt.Sprintf(
-							msgformat,
-							margs...,
-						),
-					},
-				})
-			}
-		},
-		"setcategory": func(s *discordgo.Session, i *discordgo.InteractionCreate, db *mongo.Client) {
-			margs := []interface{}{
-				i.Data.Options[0].RoleValue(nil, "").ID,
-				i.Data.Options[1].RoleValue(nil, "").ID,
-			}
-			var msgformat string
-			mr, err := checkManageRoles(i.Member, i.ChannelID, s)
-			if err != nil || mr == false {
+			// disable mentions by passing a zero'd allowmentions
+			var allowedMentions discordgo.MessageAllowedMentions
+
+			if len(i.ApplicationCommandData().Options) > 0 {
+				uid := i.ApplicationCommandData().Options[0].UserValue(nil).ID
+				changed, conflicts, err := resyncMember(s, store, i.GuildID, uid)
+				if changed {
+					msgformat = fmt.Sprintf(`fixed the categories of <@%s>!`, uid)
+				} else {
+					msgformat = fmt.Sprintf(`<@%s> was already up to date!`, uid)
+				}
+				for _, cat := range conflicts {
+					msgformat += fmt.Sprintf("\n<@%s> has more than one role from <@&%s>, which is exclusive. I can't tell which one they picked last, so remove the others by hand.", uid, cat)
+				}
 				if err != nil {
 					msgformat = err.Error()
-				} else {
-					msgformat = "User does not have manage roles permission!"
 				}
 				s.InteractionRespond(i.Interaction, &discordgo.InteractionResponse{
 					Type: discordgo.InteractionResponseChannelMessageWithSource,
-					Data: &discordgo.InteractionApplicationCommandResponseData{
-						Content: fmt.Sprintf(
-							msgformat,
-						),
+					Data: &discordgo.InteractionResponseData{
+						AllowedMentions: &allowedMentions,
+						Content: msgformat,
 					},
 				})
 				return
 			}
-			err = setCategory(i.Data.Options[0].RoleValue(nil, "").ID, i.Data.Options[1].RoleValue(nil, "").ID, i.GuildID, db)
+
+			// a whole server takes longer than the 3 seconds an interaction
+			// gets to respond, so acknowledge it and report back later
+			err = s.InteractionRespond(i.Interaction, &discordgo.InteractionResponse{
+				Type: discordgo.InteractionResponseDeferredChannelMessageWithSource,
+			})
 			if err != nil {
-				msgformat = err.Error()
-				s.InteractionRespond(i.Interaction, &discordgo.InteractionResponse{
-					Type: discordgo.InteractionResponseChannelMessageWithSource,
-					Data: &discordgo.InteractionApplicationCommandResponseData{
-						Content: fmt.Sprintf(
-							msgformat,
-						),
-					},
-				})
-			} else {
-				msgformat = `category <@&%s> now contains role <@&%s>`
-				// disable mentions by passing a zero'd allowmentions
-				var allowedMentions discordgo.MessageAllowedMentions
-				s.InteractionRespond(i.Interaction, &discordgo.InteractionResponse{
-					Type: discordgo.InteractionResponseChannelMessageWithSource,
-					Data: &discordgo.InteractionApplicationCommandResponseData{
+				fmt.Println(err)
+				return
+			}
+
+			go func() {
+				checked, fixed, failed, conflicted, err := reconcileGuild(s, store, i.GuildID, func(checked int, fixed int) {
+					_, err := s.FollowupMessageCreate(i.Interaction, false, &discordgo.WebhookParams{
+						Content: fmt.Sprintf("Checked %d members so far, fixed %d...", checked, fixed),
 						AllowedMentions: &allowedMentions,
-						Content: fmt.Sprintf(
-							msgformat,
-							margs...,
-						),
-					},
+					})
+					if err != nil {
+						fmt.Println(err)
+					}
 				})
-			}
-		},
-		"removecategory": func(s *discordgo.Session, i *discordgo.InteractionCreate, db *mongo.Client) {
-			margs := []interface{}{
-				i.Data.Options[0].RoleValue(nil, "").ID,
-			}
-			var msgformat string
-			mr, err := checkManageRoles(i.Member, i.ChannelID, s)
-			if err != nil || mr == false {
-				if err != nil {
+				if err == errReconcileRunning {
 					msgformat = err.Error()
+				} else if err != nil {
+					msgformat = fmt.Sprintf("Resync stopped after checking %d members, fixed %d: %s", checked, fixed, err.Error())
 				} else {
-					msgformat = "User does not have manage roles permission!"
+					msgformat = fmt.Sprintf("Resync done! Checked %d members, fixed %d.", checked, fixed)
 				}
-				s.InteractionRespond(i.Interaction, &discordgo.InteractionResponse{
-					Type: discordgo.InteractionResponseChannelMessageWithSource,
-					Data: &discordgo.InteractionApplicationCommandResponseData{
-						Content: fmt.Sprintf(
-							msgformat,
-						),
-					},
-				})
-				return
-			}
-			err = removeCategory(i.Data.Options[0].RoleValue(nil, "").ID, i.GuildID, db)
-			if err != nil {
-				msgformat = err.Error()
-				s.InteractionRespond(i.Interaction, &discordgo.InteractionResponse{
-					Type: discordgo.InteractionResponseChannelMessageWithSource,
-					Data: &discordgo.InteractionApplicationCommandResponseData{
-						Content: fmt.Sprintf(
-							msgformat,
-						),
-					},
-				})
-			} else {
-				msgformat = `<@&%s> is no longer a category!`
-				// disable mentions by passing a zero'd allowmentions
-				var allowedMentions discordgo.MessageAllowedMentions
-				s.InteractionRespond(i.Interaction, &discordgo.InteractionResponse{
-					Type: discordgo.InteractionResponseChannelMessageWithSource,
-					Data: &discordgo.InteractionApplicationCommandResponseData{
-						AllowedMentions: &allowedMentions,
-						Content: fmt.Sprintf(
-							msgformat,
-							margs...,
-						),
-					},
+				if err != errReconcileRunning {
+					msgformat += failedNotice(failed)
+					msgformat += conflictNotice(conflicted)
+				}
+				_, err = s.InteractionResponseEdit(i.Interaction, &discordgo.WebhookEdit{
+					Content: &msgformat,
+					AllowedMentions: &allowedMentions,
 				})
-			}
+				if err != nil {
+					fmt.Println(err)
+				}
+			}()
 		},
-		"updatecategory": func(s *discordgo.Session, i *discordgo.InteractionCreate, db *mongo.Client) {
-			margs := []interface{}{
-				i.Data.Options[0].RoleValue(nil, "").ID,
-				i.Data.Options[1].RoleValue(nil, "").ID,
-			}
+		"diagnose": func(s *discordgo.Session, i *discordgo.InteractionCreate, store CategoryStore) {
 			var msgformat string
-			mr, err := checkManageRoles(i.Member, i.ChannelID, s)
+			mr, err := checkAccess(i.Member, i.GuildID, s, store, false)
 			if err != nil || mr == false {
 				if err != nil {
 					msgformat = err.Error()
 				} else {
-					msgformat = "User does not have manage roles permission!"
+					msgformat = "User does not have manage roles permission or a manager role!"
 				}
 				s.InteractionRespond(i.Interaction, &discordgo.InteractionResponse{
 					Type: discordgo.InteractionResponseChannelMessageWithSource,
-					Data: &discordgo.InteractionApplicationCommandResponseData{
-						Content: fmt.Sprintf(
-							msgformat,
-						),
+					Data: &discordgo.InteractionResponseData{
+						Content: msgformat,
 					},
 				})
 				return
 			}
-			err = updateCategory(i.Data.Options[1].RoleValue(nil, "").ID, i.Data.Options[0].RoleValue(nil, "").ID, i.GuildID, db)
+			broken, err := brokenMappings(s, store, i.GuildID)
 			if err != nil {
 				msgformat = err.Error()
 				s.InteractionRespond(i.Interaction, &discordgo.InteractionResponse{
 					Type: discordgo.InteractionResponseChannelMessageWithSource,
-					Data: &discordgo.InteractionApplicationCommandResponseData{
-						Content: fmt.Sprintf(
-							msgformat,
-						),
+					Data: &discordgo.InteractionResponseData{
+						Content: msgformat,
 					},
 				})
 			} else {
-				msgformat = `<@&%s> is now part of <@&%s>!`
+				var embed discordgo.MessageEmbed
+				embed.Color = 0xCC00CC
+				embed.Title = "Diagnosis"
+				embed.Description = "Everything looks fine!"
+				if len(broken) > 0 {
+					embed.Description = ""
+					for _, n := range broken {
+						embed.Description += n + "\n"
+					}
+				}
+				var embeds []*discordgo.MessageEmbed
+				embeds = append(embeds, &embed)
 				// disable mentions by passing a zero'd allowmentions
 				var allowedMentions discordgo.MessageAllowedMentions
 				s.InteractionRespond(i.Interaction, &discordgo.InteractionResponse{
 					Type: discordgo.InteractionResponseChannelMessageWithSource,
-					Data: &discordgo.InteractionApplicationCommandResponseData{
+					Data: &discordgo.InteractionResponseData{
 						AllowedMentions: &allowedMentions,
-						Content: fmt.Sprintf(
-							msgformat,
-							margs...,
-						),
+						Embeds: embeds,
 					},
 				})
 			}
 		},
-		"unsetcategory": func(s *discordgo.Session, i *discordgo.InteractionCreate, db *mongo.Client) {
-			margs := []interface{}{
-				i.Data.Options[0].RoleValue(nil, "").ID,
-			}
+		"config": func(s *discordgo.Session, i *discordgo.InteractionCreate, store CategoryStore) {
 			var msgformat string
-			mr, err := checkManageRoles(i.Member, i.ChannelID, s)
+			// managers can't make more managers
+			mr, err := checkManageRoles(i.Member, i.GuildID, s)
 			if err != nil || mr == false {
 				if err != nil {
 					msgformat = err.Error()
@@ -310,97 +601,85 @@ var (
 				}
 				s.InteractionRespond(i.Interaction, &discordgo.InteractionResponse{
 					Type: discordgo.InteractionResponseChannelMessageWithSource,
-					Data: &discordgo.InteractionApplicationCommandResponseData{
-						Content: fmt.Sprintf(
-							msgformat,
-						),
+					Data: &discordgo.InteractionResponseData{
+						Content: msgformat,
 					},
 				})
 				return
 			}
-			err = unsetCategory(i.Data.Options[0].RoleValue(nil, "").ID, i.GuildID, db)
-			if err != nil {
-				msgformat = err.Error()
-				s.InteractionRespond(i.Interaction, &discordgo.InteractionResponse{
-					Type: discordgo.InteractionResponseChannelMessageWithSource,
-					Data: &discordgo.InteractionApplicationCommandResponseData{
-						Content: fmt.Sprintf(
-							msgformat,
-						),
-					},
-				})
-			} else {
-				msgformat = `<@&%s> is no longer part of a category!`
-				// disable mentions by passing a zero'd allowmentions
-				var allowedMentions discordgo.MessageAllowedMentions
-				s.InteractionRespond(i.Interaction, &discordgo.InteractionResponse{
-					Type: discordgo.InteractionResponseChannelMessageWithSource,
-					Data: &discordgo.InteractionApplicationCommandResponseData{
-						AllowedMentions: &allowedMentions,
-						Content: fmt.Sprintf(
-							msgformat,
-							margs...,
-						),
-					},
-				})
-			}
-		},
-		"listall": func(s *discordgo.Session, i *discordgo.InteractionCreate, db *mongo.Client) {
-			var msgformat string
-			mr, err := checkManageRoles(i.Member, i.ChannelID, s)
-			if err != nil || mr == false {
+			// disable mentions by passing a zero'd allowmentions
+			var allowedMentions discordgo.MessageAllowedMentions
+
+			opt := i.ApplicationCommandData().Options[0]
+			switch opt.Name {
+			case "auto-position":
+				on := opt.Options[0].BoolValue()
+				err = store.SetAutoPosition(on, i.GuildID)
 				if err != nil {
 					msgformat = err.Error()
+				} else if on {
+					msgformat = "Roles will now be moved below their category whenever it changes. Use /category reorder to fix the roles which aren't yet."
 				} else {
-					msgformat = "User does not have manage roles permission!"
+					msgformat = "Roles will no longer be moved below their category."
 				}
-				s.InteractionRespond(i.Interaction, &discordgo.InteractionResponse{
-					Type: discordgo.InteractionResponseChannelMessageWithSource,
-					Data: &discordgo.InteractionApplicationCommandResponseData{
-						Content: fmt.Sprintf(
-							msgformat,
-						),
-					},
-				})
-				return
-			}
-			roles, err := listRoles(i.GuildID, db)
-			if err != nil {
-				msgformat = err.Error()
-				s.InteractionRespond(i.Interaction, &discordgo.InteractionResponse{
-					Type: discordgo.InteractionResponseChannelMessageWithSource,
-					Data: &discordgo.InteractionApplicationCommandResponseData{
-						Content: fmt.Sprintf(
-							msgformat,
-						),
-					},
-				})
-			} else {
-				var embed discordgo.MessageEmbed
-				embed.Color = 0xCC00CC
-				embed.Title = "Categories"
-				embed.Description = ""
-				for _, n := range roles {
-					embed.Description += "<@&" + n.Category + ">\n"
-					for _, k := range n.Roles {
-						embed.Description += "<@&" + k + "> "
+			case "managers":
+				sub := opt.Options[0]
+				switch sub.Name {
+				case "add":
+					readOnly := len(sub.Options) > 1 && sub.Options[1].BoolValue()
+					role := sub.Options[0].RoleValue(nil, "").ID
+					err = store.AddManager(role, readOnly, i.GuildID)
+					if err != nil {
+						msgformat = err.Error()
+					} else if readOnly {
+						msgformat = fmt.Sprintf("<@&%s> can now use /category list!", role)
+					} else {
+						msgformat = fmt.Sprintf("<@&%s> can now manage categories!", role)
+					}
+				case "remove":
+					role := sub.Options[0].RoleValue(nil, "").ID
+					err = store.RemoveManager(role, i.GuildID)
+					if err != nil {
+						msgformat = err.Error()
+					} else {
+						msgformat = fmt.Sprintf("<@&%s> is no longer a manager!", role)
+					}
+				case "list":
+					managers, err := store.Managers(i.GuildID)
+					if err != nil {
+						msgformat = err.Error()
+						break
+					}
+					if len(managers) == 0 {
+						msgformat = "No manager roles! Only members with manage roles permission can use the commands."
+						break
+					}
+					msgformat = "Manager roles:\n"
+					for _, k := range managers {
+						msgformat += "<@&" + k.Role + ">"
+						if k.ReadOnly {
+							msgformat += " (read-only)"
+						}
+						msgformat += "\n"
 					}
-					embed.Description += "\n"
 				}
-				var embeds []*discordgo.MessageEmbed
-				embeds = append(embeds, &embed)
-				// disable mentions by passing a zero'd allowmentions
-				var allowedMentions discordgo.MessageAllowedMentions
-				s.InteractionRespond(i.Interaction, &discordgo.InteractionResponse{
-					Type: discordgo.InteractionResponseChannelMessageWithSource,
-					Data: &discordgo.InteractionApplicationCommandResponseData{
-						AllowedMentions: &allowedMentions,
-						Embeds: embeds,
-					},
-				})
 			}
+			s.InteractionRespond(i.Interaction, &discordgo.InteractionResponse{
+				Type: discordgo.InteractionResponseChannelMessageWithSource,
+				Data: &discordgo.InteractionResponseData{
+					AllowedMentions: &allowedMentions,
+					Content: msgformat,
+				},
+			})
 		},
 	}
+	// componentHandlers answer buttons and select menus, by the part of
+	// their custom ID before the colon
+	componentHandlers = map[string]func(s *discordgo.Session, i *discordgo.InteractionCreate, store CategoryStore, arg string) {
+		"import-confirm": importConfirm,
+		"import-cancel": importCancel,
+		"panel": panelSelect,
+	}
 )
 
 const (
@@ -408,425 +687,511 @@ const (
 	port    = ":50051"
 )
 
-type guildCategories struct {
-	Guild string
-	Categories []categoryHolder
-}
-
-type guildRoles struct {
-	Guild string
-	Roles []roleHolder
-}
-
-// i am so horrible at naming things
-type catRoles struct {
-	Category string
-	Roles []string
-}
-
-type roleHolder struct {
-	Role string
-	Category string
-}
+// checkManageRoles reports whether a member has the manage roles permission
+// in a guild, through any of their roles or by owning it
+func checkManageRoles(member *discordgo.Member, gid string, s *discordgo.Session) (perms bool, err error) {
+	var computed int64
+	guild, err := s.State.Guild(gid)
+	if err != nil {
+		// the state cache doesn't always have the guild, but Discord
+		// sends the member's permissions along with every interaction
+		err = nil
+		computed = member.Permissions
+		if computed&discordgo.PermissionAdministrator == discordgo.PermissionAdministrator {
+			computed = discordgo.PermissionAll
+		}
+	} else {
+		computed = memberPermissions(guild, member)
+	}
 
-type categoryHolder struct {
-	Role string
+	perms = computed&discordgo.PermissionManageRoles == discordgo.PermissionManageRoles
+	return
 }
 
-func checkManageRoles(member *discordgo.Member, channelID string, s *discordgo.Session) (perms bool, err error) {
-	channel, err := s.State.Channel(channelID)
+// The error handling here is bad. I don't know how to improve it.
+func guildMemberUpdate(s *discordgo.Session, m *discordgo.GuildMemberUpdate, store CategoryStore) {
+	// Find all of the roles a member has which are stored in the db
+	gRoles, err := store.Roles(m.GuildID)
 	if err != nil {
+		fmt.Println(err)
 		return
 	}
 
-	guild, err := s.State.Guild(channel.GuildID)
+	// Find all the roles a member has that are considered categories
+	gCat, err := store.Categories(m.GuildID)
 	if err != nil {
+		fmt.Println(err)
 		return
 	}
 
-	if member.User.ID == guild.OwnerID {
-		perms = true
-		return
+	// the roles from before the update tell which role is the newest
+	var before []string
+	if m.BeforeUpdate != nil {
+		before = m.BeforeUpdate.Roles
 	}
 
-	for _, role := range guild.Roles {
-		for _, roleID := range member.Roles {
-			if role.ID == roleID {
-				if role.Permissions&discordgo.PermissionManageRoles == discordgo.PermissionManageRoles {
-					perms = true
-					return
-				}
-			}
-		}
+	_, _, err = syncMember(s, m.GuildID, m.User.ID, m.Roles, before, gRoles, gCat)
+	if err != nil {
+		fmt.Println(err)
 	}
+}
 
+// syncMember adds the categories a member's roles require and removes the
+// ones they don't, given every role and category of the guild.
+// It reports whether the member's roles were changed, and the exclusive
+// categories the member holds several roles of without it being known which
+// one is the newest. Those roles are left alone.
+func syncMember(s *discordgo.Session, gid string, uid string, memberRoles []string, before []string, gRoles []roleHolder, gCat []categoryHolder) (changed bool, conflicts []string, err error) {
+	add, remove, conflicts := memberChanges(memberRoles, before, gRoles, gCat)
+	for _, role := range remove {
+		err = s.GuildMemberRoleRemove(gid, uid, role)
+		if err != nil {
+			return
+		}
+		changed = true
+	}
+	for _, role := range add {
+		err = s.GuildMemberRoleAdd(gid, uid, role)
+		if err != nil {
+			return
+		}
+		changed = true
+	}
 	return
 }
 
-func listRoles(gid string, db *mongo.Client) (ret []catRoles, err error) {
-	rolesCollection := db.Database("test").Collection("roles")
-	categoriesCollection := db.Database("test").Collection("categories")
+// memberChanges works out which roles syncMember has to add to and remove
+// from a member, without talking to Discord. conflicts are the exclusive
+// categories the member holds several roles of without it being known which
+// one is the newest.
+func memberChanges(memberRoles []string, before []string, gRoles []roleHolder, gCat []categoryHolder) (add []string, remove []string, conflicts []string) {
+	var roles []roleHolder
+	for _, n := range memberRoles {
+		for _, k := range gRoles {
+			if n == k.Role {
+				roles = append(roles, k)
+			}
+		}
+	}
 
-	var gCats guildCategories
-	var gRoles guildRoles
+	// a member may only have one role from an exclusive category
+	// keep the newest one and remove the rest
+	for _, category := range gCat {
+		if category.Exclusive == false {
+			continue
+		}
+		var held []string
+		for _, role := range roles {
+			if (role.Category == category.Role) {
+				held = append(held, role.Role)
+			}
+		}
+		if len(held) < 2 {
+			continue
+		}
 
-	filter := bson.D{{"guild", gid}}
-	err = categoriesCollection.FindOne(context.Background(), filter).Decode(&gCats)
-	if err == mongo.ErrNoDocuments {
-		err = errors.New("No categories to list! Register a category with /makecategory")
-		return
-	}
-	if err != nil {
-		return
+		keep := newestRole(held, before)
+		if keep == "" {
+			// there's no telling which role the member picked last,
+			// removing any of them could take away the one they wanted
+			conflicts = append(conflicts, category.Role)
+			continue
+		}
+		removed := make(map[string]bool)
+		for _, role := range held {
+			if role == keep {
+				continue
+			}
+			remove = append(remove, role)
+			removed[role] = true
+		}
+		// the removed roles no longer count for their other categories either
+		var kept []roleHolder
+		for _, role := range roles {
+			if removed[role.Role] == false {
+				kept = append(kept, role)
+			}
+		}
+		roles = kept
 	}
 
-	err = rolesCollection.FindOne(context.Background(), filter).Decode(&gRoles)
-	if err == mongo.ErrNoDocuments {
-		for _, n := range gCats.Categories {
-			var tmp catRoles
-			tmp.Category = n.Role
-			ret = append(ret, tmp)
+	var categories []categoryHolder
+	for _, n := range memberRoles {
+		for _, k := range gCat {
+			if n == k.Role {
+				categories = append(categories, k)
+			}
 		}
-		return
-	}
-	if err != nil {
-		return
 	}
 
+	// count the roles requiring each category, and how many
+	// each category needs before the user gets it
+	counts := make(map[string]int)
+	for _, role := range roles {
+		counts[role.Category]++
+	}
+	needed := make(map[string]int)
+	for _, k := range gCat {
+		needed[k.Role] = k.minRoles()
+	}
 
-	for _, n := range gRoles.Roles {
-		found := false
-		for i, k := range ret {
-			if k.Category == n.Category {
-				ret[i].Roles = append(ret[i].Roles, n.Role)
+	// if a user has enough roles that require a category
+	// but does not have that category, add that category to the user
+	added := make(map[string]bool)
+	for _, role := range roles {
+		found := added[role.Category]
+		for _, category := range categories {
+			if (role.Category == category.Role) {
 				found = true
 				break
 			}
 		}
-		if found == false {
-			var tmp catRoles
-			tmp.Category = n.Category
-			tmp.Roles = append(tmp.Roles, n.Role)
-			ret = append(ret, tmp)
+
+		if found == false && counts[role.Category] >= needed[role.Category] {
+			add = append(add, role.Category)
+			added[role.Category] = true
+		}
+	}
+
+	// if a user has a category
+	// check that it has enough roles that require it
+	// remove the category if the user does not
+	for _, category := range categories {
+		if counts[category.Role] < category.minRoles() {
+			remove = append(remove, category.Role)
 		}
 	}
-	for _, n := range gCats.Categories {
+	return
+}
+
+// newestRole picks the first role which isn't in before, the roles a member
+// had before their last update. It returns "" if that isn't known, or if the
+// member already had every one of the roles.
+func newestRole(roles []string, before []string) string {
+	if before == nil {
+		return ""
+	}
+	for _, n := range roles {
 		found := false
-		for _, k := range ret {
-			if k.Category == n.Role {
+		for _, k := range before {
+			if n == k {
 				found = true
 				break
 			}
 		}
 		if found == false {
-			var tmp catRoles
-			tmp.Category = n.Role
-			ret = append(ret, tmp)
+			return n
 		}
 	}
-	return
+	return ""
 }
 
-func unsetCategory(role string, gid string, db *mongo.Client) error {
-	collection := db.Database("test").Collection("roles")
-
-	filter :=  bson.D{{"guild", gid}}
-	res, err := collection.UpdateOne(context.Background(), filter, bson.D{{"$pull", bson.D{{"roles", bson.D{{"role", role}}}}}})
+// registers new commands as soon as a guild is joined
+// and fixes up any members that changed while the bot was away
+func guildCreate(s *discordgo.Session, event *discordgo.GuildCreate, store CategoryStore) {
+	if event.Unavailable {
+		return
+	}
+	restored, err := store.RestoreGuild(event.Guild.ID)
 	if err != nil {
-		return err
+		fmt.Println(err)
 	}
-	if res.ModifiedCount == 0 {
-		return errors.New("Did not unset any categories!")
+	if restored {
+		postNotice(s, event.Guild.ID, "Welcome back! Your categories from last time were restored.")
 	}
-	return nil
-}
+	guildCommands(s, event.Guild.ID)
 
-func updateCategory(cat string, role string, gid string, db *mongo.Client) error {
-	collection := db.Database("test").Collection("roles")
-
-	filter := bson.D{{"guild", gid}}
-	var gCat guildCategories
-	// check if new category is a category
-	err := db.Database("test").Collection("categories").FindOne(context.Background(), filter).Decode(&gCat)
-	if err == mongo.ErrNoDocuments {
-		return errors.New("No categories registered! Register a category with /makecategory")
-	}
-	if err != nil {
-		return err
-	}
-	found := false
-	for _, k := range gCat.Categories {
-		if k.Role == cat {
-			found = true
+	go func() {
+		// other guilds connecting at the same time wait their turn
+		reconcileMu.Lock()
+		checked, fixed, failed, conflicted, err := reconcileGuild(s, store, event.Guild.ID, nil)
+		reconcileMu.Unlock()
+		if err != nil {
+			log.Printf("reconciling guild %s: %v", event.Guild.ID, err)
+			return
 		}
-	}
-	if found == false {
-		return errors.New("Category is not a category!")
-	}
+		if checked > 0 {
+			log.Printf("reconciled guild %s: checked %d members, fixed %d, failed %d, %d with several roles from an exclusive category", event.Guild.ID, checked, fixed, failed, len(conflicted))
+		}
+	}()
+}
 
-	arrayFilter := options.Update().SetArrayFilters(options.ArrayFilters{Filters: []interface{}{bson.M{"elem.role": role}}})
-	res, err := collection.UpdateOne(context.Background(),
-		filter,
-		bson.D{{"$set", bson.D{{"roles.$[elem].category", cat}}}},
-		arrayFilter)
-	if err == mongo.ErrNoDocuments {
-		return errors.New("No roles set! Set a role to a category with /setcategory")
+// checkAccess reports whether a member may use the category commands,
+// either with the manage roles permission or through one of the guild's
+// manager roles. Read-only managers only pass if readOnly is set.
+func checkAccess(member *discordgo.Member, gid string, s *discordgo.Session, store CategoryStore, readOnly bool) (perms bool, err error) {
+	perms, err = checkManageRoles(member, gid, s)
+	if err != nil || perms {
+		return
 	}
+
+	managers, err := store.Managers(gid)
 	if err != nil {
-		return err
+		return
 	}
-	if res.ModifiedCount == 0 {
-		return errors.New("Did not update any roles! Is the role registered to a category?")
+	for _, k := range managers {
+		if k.ReadOnly && !readOnly {
+			continue
+		}
+		for _, n := range member.Roles {
+			if n == k.Role {
+				perms = true
+				return
+			}
+		}
 	}
-	return nil
+	return
 }
 
-func removeCategory(cat string, gid string, db *mongo.Client) error {
-	collection := db.Database("test").Collection("categories")
+// archiveRetention is how long a guild's categories are kept after the bot
+// is removed from it
+var archiveRetention = 30 * 24 * time.Hour
 
-	filter := bson.D{{"guild", gid}}
-	res, err := collection.UpdateOne(context.Background(), filter, bson.D{{"$pull", bson.D{{"categories", bson.D{{"role", cat}}}}}})
-	if err != nil {
-		return err
+// archives a guild's categories when the bot is removed from it,
+// they come back if the bot is invited again within archiveRetention
+func guildDelete(s *discordgo.Session, event *discordgo.GuildDelete, store CategoryStore) {
+	// the guild is only down for a bit, the bot is still in it
+	if event.Unavailable {
+		return
 	}
-	if res.ModifiedCount == 0 {
-		return errors.New("Did not delete any categories!")
+	if archiveRetention <= 0 {
+		deleted, err := store.DeleteGuild(event.ID)
+		if err != nil {
+			fmt.Println(err)
+		} else if deleted {
+			log.Printf("removed from guild %s, deleted its categories", event.ID)
+		}
+		return
 	}
-
-	collection = db.Database("test").Collection("roles")
-	res, err = collection.UpdateOne(context.Background(), filter, bson.D{{"$pull", bson.D{{"roles", bson.D{{"category", cat}}}}}})
+	archived, err := store.ArchiveGuild(event.ID, time.Now().Add(archiveRetention))
 	if err != nil {
-		return err
+		fmt.Println(err)
+		return
 	}
-
-	return nil
+	if !archived {
+		return
+	}
+	log.Printf("removed from guild %s, archived its categories until %s", event.ID, time.Now().Add(archiveRetention).Format(time.RFC1123))
 }
 
-func setCategory(cat string, role string, gid string, db *mongo.Client) error {
-	collection := db.Database("test").Collection("roles")
-	filter := bson.D{{"guild", gid}}
-
-	var gCats guildCategories
-
-	err := db.Database("test").Collection("categories").FindOne(context.Background(), filter).Decode(&gCats)
-	if err == mongo.ErrNoDocuments {
-		return errors.New("No categories registered! Register a category with /makecategory")
+// forgets roles which were deleted from the server, so they don't linger
+// in /category list or get added to members
+func guildRoleDelete(s *discordgo.Session, event *discordgo.GuildRoleDelete, store CategoryStore) {
+	gCat, err := store.Categories(event.GuildID)
+	if err != nil {
+		fmt.Println(err)
+		return
 	}
+	gRoles, err := store.Roles(event.GuildID)
 	if err != nil {
-		return err
+		fmt.Println(err)
+		return
 	}
 
-	// check if this role is a category
-	// and that this category is a category
-	found := false
-	for _, k := range gCats.Categories {
-		if k.Role == role {
-			return errors.New("Role is a category!")
+	var notice string
+	changed := false
+	for _, k := range gCat {
+		if k.Role != event.RoleID {
+			continue
 		}
-		if k.Role == cat {
-			found = true
-			break
+		changed = true
+		err = store.RemoveCategory(event.RoleID, event.GuildID)
+		if err != nil {
+			fmt.Println(err)
+			return
 		}
-	}
-	if found == false {
-		return errors.New("Category is not a category!")
+		notice = fmt.Sprintf("A deleted role (%s) was a category, so it was removed.", event.RoleID)
+		var orphans string
+		for _, n := range gRoles {
+			if n.Category == event.RoleID {
+				orphans += " <@&" + n.Role + ">"
+			}
+		}
+		if orphans != "" {
+			notice += " These roles were removed from it:" + orphans
+		}
+		break
 	}
 
-	var gRoles guildRoles
-
-	// check if this role already has a category
-	err = collection.FindOne(context.Background(), filter).Decode(&gRoles)
-	if err == mongo.ErrNoDocuments {
-		_, errnew := collection.InsertOne(context.Background(), bson.M{"guild": gid, "roles": bson.A{bson.D{{"role", role}, {"category", cat}}}})
-		return errnew
-	}
-	if err != nil {
-		return err
+	// a role can be in several categories
+	var from string
+	for _, k := range gRoles {
+		if k.Role == event.RoleID {
+			from += " <@&" + k.Category + ">"
+		}
 	}
-
-	for _, k := range gRoles.Roles {
-		if k.Role == role {
-			return errors.New("Role already belongs to a category!")
+	if from != "" {
+		changed = true
+		err = store.UnsetCategory("", event.RoleID, event.GuildID)
+		if err != nil {
+			fmt.Println(err)
+			return
 		}
+		// the role may have been a category as well
+		notice += fmt.Sprintf(" A deleted role (%s) was removed from these categories:%s", event.RoleID, from)
 	}
 
-	var ins roleHolder
-	ins.Role = role
-	ins.Category = cat
-	_, err = collection.UpdateOne(context.Background(), filter, bson.D{{"$push", bson.D{{"roles", ins}}}})
-	if err != nil {
-		return err
+	err = store.RemoveManager(event.RoleID, event.GuildID)
+	if err == nil {
+		notice += fmt.Sprintf(" A deleted role (%s) was removed from the manager roles.", event.RoleID)
+	} else if err != errNotManager {
+		fmt.Println(err)
 	}
 
-	return nil
-}
-
-func addCategory(cat string, gid string, db *mongo.Client) error {
-	collection := db.Database("test").Collection("categories")
-
-	var guild guildCategories
-
-	// check if this role is already a category
-	filter := bson.D{{"guild", gid}}
-	err := collection.FindOne(context.Background(), filter).Decode(&guild)
-	if err == mongo.ErrNoDocuments {
-		_, errnew := collection.InsertOne(context.Background(), bson.M{"guild": gid, "categories": bson.A{bson.D{{"role", cat}}}})
-		return errnew
+	if changed {
+		refreshPanels(s, store, event.GuildID)
 	}
-	if err != nil {
-		return err
+	if notice != "" {
+		postNotice(s, event.GuildID, strings.TrimSpace(notice))
 	}
+}
 
-	for _, n := range guild.Categories {
-		if n.Role == cat {
-			return errors.New("Role is already a category!")
-		}
-	}
+// postNotice tells a server about something the bot did on its own, in the
+// server's system messages channel if it has one.
+func postNotice(s *discordgo.Session, gid string, notice string) {
+	log.Printf("guild %s: %s", gid, notice)
 
-	var ins categoryHolder
-	ins.Role = cat
-	_, err = collection.UpdateOne(context.Background(), filter, bson.D{{"$push", bson.D{{"categories", ins}}}})
+	guild, err := s.State.Guild(gid)
+	if err != nil || guild.SystemChannelID == "" {
+		return
+	}
+	// disable mentions by passing a zero'd allowmentions
+	var allowedMentions discordgo.MessageAllowedMentions
+	_, err = s.ChannelMessageSendComplex(guild.SystemChannelID, &discordgo.MessageSend{
+		Content: notice,
+		AllowedMentions: &allowedMentions,
+	})
 	if err != nil {
-		return err
+		fmt.Println(err)
 	}
-
-	return nil
 }
 
-// The error handling here is bad. I don't know how to improve it.
-func guildMemberUpdate(s *discordgo.Session, m *discordgo.GuildMemberUpdate, db *mongo.Client) {
-	// Find all of the roles a member has which are stored in the db
-	collection := db.Database("test").Collection("roles")
-
-	var gRoles guildRoles
-
-	filter := bson.D{{"guild", m.GuildID}}
-	err := collection.FindOne(context.Background(), filter).Decode(&gRoles)
+// connectMongo connects to the MongoDB server and makes sure it is up
+func connectMongo(uri string) (*mongo.Client, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	mongoClient, err := mongo.Connect(ctx, options.Client().ApplyURI(uri))
 	if err != nil {
-		fmt.Println(err)
-		return
+		return nil, err
 	}
 
-	var roles []roleHolder
-	for _, n := range m.Roles {
-		for _, k := range gRoles.Roles {
-			if n == k.Role {
-				roles = append(roles, k)
-			}
-		}
+	err = mongoClient.Ping(ctx, readpref.Primary())
+	if err != nil {
+		return nil, err
 	}
+	return mongoClient, nil
+}
 
-	// Find all the roles a member has that are considered categories
-	collection = db.Database("test").Collection("categories")
-
-	var gCat guildCategories
-	err = collection.FindOne(context.Background(), filter).Decode(&gCat)
+func main() {
+	cfg, err := loadConfig(os.Args[0], os.Args[1:])
 	if err != nil {
-		fmt.Println(err)
-		return
+		log.Fatal(err)
 	}
-
-	var categories []categoryHolder
-	for _, n := range m.Roles {
-		for _, k := range gCat.Categories {
-			if n == k.Role {
-				categories = append(categories, k)
-			}
+	if errs := cfg.validate(); len(errs) > 0 {
+		for _, err := range errs {
+			fmt.Fprintln(os.Stderr, "config error:", err)
 		}
+		os.Exit(2)
 	}
 
-	// if a user has a role that requires a category
-	// but does not have that category, add that category to the user
-	for _, role := range roles {
-		found := false
-		for _, category := range categories {
-			if (role.Category == category.Role) {
-				found = true
-				break
-			}
-		}
+	syncMaxMembers = cfg.SyncMaxMembers
+	archiveRetention = time.Duration(cfg.ArchiveDays) * 24 * time.Hour
+	commandMode = cfg.Commands
+	devGuilds = cfg.DevGuilds
+	cleanupCommands = cfg.CleanupCommands
 
-		if found == false {
-			err = s.GuildMemberRoleAdd(m.GuildID, m.User.ID, role.Category)
-			if err != nil {
-				fmt.Println(err)
-				return
-			}
+	var mongoClient *mongo.Client
+	if cfg.needsMongo() {
+		mongoClient, err = connectMongo(cfg.Mongo.URI)
+		if err != nil {
+			log.Fatal(err)
 		}
 	}
 
-	// if a user has a category
-	// check that it has roles that require it
-	// remove the category if the user does not
-	for _, category := range categories {
-		found := false
-		for _, role := range roles {
-			if (role.Category == category.Role) {
-				found = true
-				break
-			}
-		}
-
-		if found == false {
-			err = s.GuildMemberRoleRemove(m.GuildID, m.User.ID, category.Role)
-			if err != nil {
-				fmt.Println(err)
-				return
-			}
+	if cfg.MigrateFrom != "" {
+		err = migrateMongo(mongoClient, cfg.MigrateFrom, cfg.Mongo)
+		if err != nil {
+			log.Fatal(err)
 		}
+		mongoClient.Disconnect(context.TODO())
+		return
 	}
-}
 
-// registers new commands as soon as a guild is joined
-func guildCreate(s *discordgo.Session, event *discordgo.GuildCreate) {
-	for _, v := range commands {
-		_, err := s.ApplicationCommandCreate(s.State.User.ID, event.Guild.ID, v)
+	var store CategoryStore
+	switch cfg.Store {
+	case "mongo":
+		store = newMongoStore(mongoClient, cfg.Mongo)
+	case "sqlite":
+		sqlite, err := newSQLiteStore(cfg.SQLite)
 		if err != nil {
-			log.Panicf("Cannot create '%v' command: %v", v.Name, err)
+			log.Fatal(err)
 		}
+		defer sqlite.Close()
+		store = sqlite
+	case "memory":
+		store = newMemoryStore()
 	}
-}
 
-func main() {
-	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
-	defer cancel()
-	mongoClient, err := mongo.Connect(ctx, options.Client().ApplyURI("mongodb://localhost:27017"))
+	if cfg.Token == "" {
+		// older versions kept the token in the database
+		collection := mongoClient.Database(cfg.Mongo.Database).Collection(cfg.Mongo.Token)
 
-	err = mongoClient.Ping(ctx, readpref.Primary())
-	if err != nil {
-		log.Fatal(err)
-	}
-
-	collection := mongoClient.Database("test").Collection("token")
-
-	var result struct {
-		Token string
-	}
-	err = collection.FindOne(context.Background(), bson.D{}).Decode(&result)
-	if err != nil {
-		log.Fatal(err)
+		var result struct {
+			Token string
+		}
+		err = collection.FindOne(context.Background(), bson.D{}).Decode(&result)
+		if err != nil && err != mongo.ErrNoDocuments {
+			log.Fatal(err)
+		}
+		cfg.Token = result.Token
 	}
 
-	if result.Token == "" {
-		fmt.Println("No token found, please insert one into DB!")
+	if cfg.Token == "" {
+		fmt.Println("No token found! Set DISCORD_TOKEN, pass -token, or insert one into the token collection.")
 		return
 	}
 
-	discord, err := discordgo.New("Bot " + result.Token)
+	discord, err := discordgo.New("Bot " + cfg.Token)
 	if err != nil {
 		log.Fatalf("error creating Discord session, %v", err)
 		return
 	}
 
 	discord.AddHandler(func(s *discordgo.Session, m *discordgo.GuildMemberUpdate) {
-		guildMemberUpdate(s, m, mongoClient)
+		guildMemberUpdate(s, m, store)
 	})
 	discord.AddHandler(func(s *discordgo.Session, i *discordgo.InteractionCreate) {
-		if h, ok := commandHandlers[i.Data.Name]; ok {
-			h(s, i, mongoClient)
+		// every handler needs the member, which DMs don't have
+		if i.Member == nil {
+			return
+		}
+		switch i.Type {
+		case discordgo.InteractionApplicationCommand:
+			if h, ok := commandHandlers[i.ApplicationCommandData().Name]; ok {
+				h(s, i, store)
+			}
+		case discordgo.InteractionApplicationCommandAutocomplete:
+			autocomplete(s, i, store)
+		case discordgo.InteractionMessageComponent:
+			// custom IDs look like "name:argument"
+			name, arg, _ := strings.Cut(i.MessageComponentData().CustomID, ":")
+			if h, ok := componentHandlers[name]; ok {
+				h(s, i, store, arg)
+			}
 		}
 	})
-	discord.AddHandler(guildCreate)
+	discord.AddHandler(func(s *discordgo.Session, event *discordgo.Ready) {
+		readyCommands(s)
+	})
+	discord.AddHandler(func(s *discordgo.Session, event *discordgo.GuildCreate) {
+		guildCreate(s, event, store)
+	})
+	discord.AddHandler(func(s *discordgo.Session, event *discordgo.GuildDelete) {
+		guildDelete(s, event, store)
+	})
+	discord.AddHandler(func(s *discordgo.Session, event *discordgo.GuildRoleDelete) {
+		guildRoleDelete(s, event, store)
+	})
 
 	discord.Identify.Intents = discordgo.IntentsGuildMembers | discordgo.IntentsGuilds
 
@@ -836,6 +1201,17 @@ func main() {
 		return
 	}
 
+	// forget the archives of servers that never invited the bot back
+	go func() {
+		for {
+			err := store.PurgeArchives(time.Now())
+			if err != nil {
+				fmt.Println(err)
+			}
+			time.Sleep(time.Hour)
+		}
+	}()
+
 	log.Println("Bot is now running. Press CTRL-C to exit.")
 	sc := make(chan os.Signal, 1)
 	signal.Notify(sc, syscall.SIGINT, syscall.SIGTERM, os.Interrupt, os.Kill)
@@ -843,9 +1219,11 @@ func main() {
 
 	discord.Close()
 
-	err = mongoClient.Disconnect(context.TODO())
-	if err != nil {
-		log.Fatal(err)
+	if mongoClient != nil {
+		err = mongoClient.Disconnect(context.TODO())
+		if err != nil {
+			log.Fatal(err)
+		}
+		fmt.Println("Connection to MongoDB closed.")
 	}
-	fmt.Println("Connection to MongoDB closed.")
 }
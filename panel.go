@@ -0,0 +1,299 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+const (
+	// Discord allows 25 options per select menu and 5 menus per message
+	maxMenuOptions = 25
+	maxPanelMenus  = 5
+)
+
+// panelMessage builds the content and select menus of a category's role
+// panel from the roles currently assigned to it.
+func panelMessage(s *discordgo.Session, store CategoryStore, gid string, cat string) (content string, components []discordgo.MessageComponent, err error) {
+	gRoles, err := store.Roles(gid)
+	if err != nil {
+		return
+	}
+	guild, err := s.State.Guild(gid)
+	if err != nil {
+		return
+	}
+	exclusive, err := isExclusive(store, gid, cat)
+	if err != nil {
+		return
+	}
+
+	var options []discordgo.SelectMenuOption
+	for _, k := range gRoles {
+		if k.Category != cat {
+			continue
+		}
+		// deleted roles are cleaned up by guildRoleDelete
+		role := findRole(guild, k.Role)
+		if role == nil {
+			continue
+		}
+		options = append(options, discordgo.SelectMenuOption{Label: role.Name, Value: role.ID})
+	}
+
+	if len(options) == 0 {
+		content = fmt.Sprintf("<@&%s> has no roles to pick yet.", cat)
+		components = []discordgo.MessageComponent{}
+		return
+	}
+	content = fmt.Sprintf("Pick roles from <@&%s> to add them, or pick roles you already have to remove them.", cat)
+	if exclusive {
+		content = fmt.Sprintf("Pick a role from <@&%s> to switch to it, or pick the role you already have to remove it.", cat)
+	}
+	if len(options) > maxMenuOptions*maxPanelMenus {
+		content += fmt.Sprintf(" Only the first %d roles fit here.", maxMenuOptions*maxPanelMenus)
+		options = options[:maxMenuOptions*maxPanelMenus]
+	}
+
+	one := 1
+	for n := 0; n < len(options); n += maxMenuOptions {
+		end := n + maxMenuOptions
+		if end > len(options) {
+			end = len(options)
+		}
+		most := end - n
+		if exclusive {
+			most = 1
+		}
+		components = append(components, discordgo.ActionsRow{
+			Components: []discordgo.MessageComponent{
+				discordgo.SelectMenu{
+					// every menu in a message needs its own custom ID
+					CustomID:    fmt.Sprintf("panel:%s:%d", cat, n/maxMenuOptions),
+					Placeholder: "Pick roles",
+					MinValues:   &one,
+					MaxValues:   most,
+					Options:     options[n:end],
+				},
+			},
+		})
+	}
+	return
+}
+
+// categoryPanel posts a role panel for a category in the current channel.
+func categoryPanel(s *discordgo.Session, i *discordgo.InteractionCreate, store CategoryStore, cat string) {
+	var msgformat string
+	mr, err := checkAccess(i.Member, i.GuildID, s, store, false)
+	if err != nil || mr == false {
+		if err != nil {
+			msgformat = err.Error()
+		} else {
+			msgformat = "User does not have manage roles permission or a manager role!"
+		}
+		s.InteractionRespond(i.Interaction, &discordgo.InteractionResponse{
+			Type: discordgo.InteractionResponseChannelMessageWithSource,
+			Data: &discordgo.InteractionResponseData{
+				Content: msgformat,
+			},
+		})
+		return
+	}
+
+	// disable mentions by passing a zero'd allowmentions
+	var allowedMentions discordgo.MessageAllowedMentions
+
+	_, err = lookupCategory(store, i.GuildID, cat)
+	if err == nil {
+		// members get to pick every role in the panel, and the category
+		// along with them
+		roles := []string{cat}
+		var gRoles []roleHolder
+		gRoles, err = store.Roles(i.GuildID)
+		for _, k := range gRoles {
+			if k.Category == cat {
+				roles = append(roles, k.Role)
+			}
+		}
+		if err == nil {
+			err = checkInvokerRoles(s, i.GuildID, roles, i.Member)
+		}
+	}
+	var content string
+	var components []discordgo.MessageComponent
+	if err == nil {
+		content, components, err = panelMessage(s, store, i.GuildID, cat)
+	}
+	var msg *discordgo.Message
+	if err == nil {
+		msg, err = s.ChannelMessageSendComplex(i.ChannelID, &discordgo.MessageSend{
+			Content:         content,
+			Components:      components,
+			AllowedMentions: &allowedMentions,
+		})
+	}
+	if err == nil {
+		err = store.AddPanel(cat, i.ChannelID, msg.ID, i.GuildID)
+	}
+
+	if err != nil {
+		msgformat = err.Error()
+	} else {
+		msgformat = fmt.Sprintf("Posted a panel for <@&%s>. It updates by itself whenever the category's roles change.", cat)
+	}
+	s.InteractionRespond(i.Interaction, &discordgo.InteractionResponse{
+		Type: discordgo.InteractionResponseChannelMessageWithSource,
+		Data: &discordgo.InteractionResponseData{
+			AllowedMentions: &allowedMentions,
+			Content:         msgformat,
+			Flags:           discordgo.MessageFlagsEphemeral,
+		},
+	})
+}
+
+// panelSelect toggles the roles a member picked from a panel. The category
+// role itself is then handled by guildMemberUpdate like for any other role
+// change. arg is the category, followed by the menu's number.
+func panelSelect(s *discordgo.Session, i *discordgo.InteractionCreate, store CategoryStore, arg string) {
+	cat, _, _ := strings.Cut(arg, ":")
+
+	// changing the roles can take a while with the rate limits
+	err := s.InteractionRespond(i.Interaction, &discordgo.InteractionResponse{
+		Type: discordgo.InteractionResponseDeferredMessageUpdate,
+	})
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+
+	var b strings.Builder
+	gRoles, err := store.Roles(i.GuildID)
+	if err != nil {
+		b.WriteString(err.Error())
+	}
+	inCategory := make(map[string]bool)
+	for _, k := range gRoles {
+		if k.Category == cat {
+			inCategory[k.Role] = true
+		}
+	}
+	exclusive, err := isExclusive(store, i.GuildID, cat)
+	if err != nil {
+		b.WriteString(err.Error())
+	}
+
+	for _, role := range i.MessageComponentData().Values {
+		if !inCategory[role] {
+			fmt.Fprintf(&b, "<@&%s> is no longer part of <@&%s>.\n", role, cat)
+			continue
+		}
+		if hasRole(i.Member, role) {
+			err = s.GuildMemberRoleRemove(i.GuildID, i.Member.User.ID, role)
+			if err == nil {
+				fmt.Fprintf(&b, "Removed <@&%s>.\n", role)
+			}
+		} else {
+			err = s.GuildMemberRoleAdd(i.GuildID, i.Member.User.ID, role)
+			if err == nil {
+				fmt.Fprintf(&b, "Added <@&%s>.\n", role)
+			}
+			// switch away from the category's other roles
+			for _, other := range i.Member.Roles {
+				if err != nil || !exclusive || !inCategory[other] {
+					continue
+				}
+				err = s.GuildMemberRoleRemove(i.GuildID, i.Member.User.ID, other)
+				if err == nil {
+					fmt.Fprintf(&b, "Removed <@&%s>.\n", other)
+				}
+			}
+		}
+		if err != nil {
+			fmt.Fprintf(&b, "Could not change <@&%s>: %s\n", role, err.Error())
+		}
+	}
+
+	// rebuilding the panel also clears what the member picked
+	content, components, err := panelMessage(s, store, i.GuildID, cat)
+	if err == nil {
+		_, err = s.InteractionResponseEdit(i.Interaction, &discordgo.WebhookEdit{
+			Content:    &content,
+			Components: &components,
+		})
+	}
+	if err != nil {
+		fmt.Println(err)
+	}
+
+	// disable mentions by passing a zero'd allowmentions
+	var allowedMentions discordgo.MessageAllowedMentions
+	_, err = s.FollowupMessageCreate(i.Interaction, false, &discordgo.WebhookParams{
+		Content:         b.String(),
+		AllowedMentions: &allowedMentions,
+		Flags:           discordgo.MessageFlagsEphemeral,
+	})
+	if err != nil {
+		fmt.Println(err)
+	}
+}
+
+// refreshPanels rebuilds every role panel in a guild after its categories
+// changed. Panels whose message was deleted are forgotten, and so are the
+// panels of deleted categories after saying so.
+func refreshPanels(s *discordgo.Session, store CategoryStore, gid string) {
+	panels, err := store.Panels(gid)
+	if err != nil || len(panels) == 0 {
+		if err != nil {
+			fmt.Println(err)
+		}
+		return
+	}
+	gCat, err := store.Categories(gid)
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	isCategory := make(map[string]bool)
+	for _, k := range gCat {
+		isCategory[k.Role] = true
+	}
+
+	// disable mentions by passing a zero'd allowmentions
+	var allowedMentions discordgo.MessageAllowedMentions
+	for _, p := range panels {
+		var content string
+		components := []discordgo.MessageComponent{}
+		forget := !isCategory[p.Category]
+		if forget {
+			content = fmt.Sprintf("<@&%s> is no longer a category.", p.Category)
+		} else {
+			content, components, err = panelMessage(s, store, gid, p.Category)
+			if err != nil {
+				fmt.Println(err)
+				continue
+			}
+		}
+
+		_, err = s.ChannelMessageEditComplex(&discordgo.MessageEdit{
+			ID:              p.Message,
+			Channel:         p.Channel,
+			Content:         &content,
+			Components:      &components,
+			AllowedMentions: &allowedMentions,
+		})
+		if restErr, ok := err.(*discordgo.RESTError); ok && restErr.Response != nil && restErr.Response.StatusCode == http.StatusNotFound {
+			forget = true
+		} else if err != nil {
+			fmt.Println(err)
+		}
+
+		if forget {
+			err = store.RemovePanel(p.Message, gid)
+			if err != nil {
+				fmt.Println(err)
+			}
+		}
+	}
+}
@@ -0,0 +1,200 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+// layoutRoles moves every role assigned to a category directly below it,
+// keeping their order otherwise. Roles in several categories go below the
+// first one. Roles at or above the bot's highest role can't be moved, so they
+// and the roles of categories above it are left where they are and listed in
+// skipped. The same goes for invoker's highest role, unless they own the
+// server, like when they'd move the roles themselves. It returns how many
+// roles changed position.
+func layoutRoles(s *discordgo.Session, store CategoryStore, gid string, invoker *discordgo.Member) (moved int, skipped []string, err error) {
+	guild, err := s.State.Guild(gid)
+	if err != nil {
+		return
+	}
+	bot, err := botMember(s, gid)
+	if err != nil {
+		return
+	}
+	if memberPermissions(guild, bot)&discordgo.PermissionManageRoles != discordgo.PermissionManageRoles {
+		err = errNoManageRoles
+		return
+	}
+	limit := 0
+	if top := highestRole(guild, bot); top != nil {
+		limit = top.Position
+	}
+	above := "my highest role, so I can't move it"
+	if invoker != nil && (invoker.User == nil || invoker.User.ID != guild.OwnerID) {
+		top := highestRole(guild, invoker)
+		if top == nil {
+			limit = 0
+			above = "your highest role, so you can't move it"
+		} else if top.Position < limit {
+			limit = top.Position
+			above = "your highest role, so you can't move it"
+		}
+	}
+
+	gCat, err := store.Categories(gid)
+	if err != nil {
+		return
+	}
+	gRoles, err := store.Roles(gid)
+	if err != nil {
+		return
+	}
+	isCategory := make(map[string]bool)
+	for _, k := range gCat {
+		isCategory[k.Role] = true
+	}
+	categoryOf := make(map[string]string)
+	for _, k := range gRoles {
+		if _, ok := categoryOf[k.Role]; !ok {
+			categoryOf[k.Role] = k.Category
+		}
+	}
+
+	// highest role first, like in Server Settings > Roles
+	var roles []*discordgo.Role
+	for _, role := range guild.Roles {
+		if role.ID != guild.ID {
+			roles = append(roles, role)
+		}
+	}
+	sort.SliceStable(roles, func(a, b int) bool {
+		return roles[a].Position > roles[b].Position
+	})
+
+	children := make(map[string][]*discordgo.Role)
+	placed := make(map[string]bool)
+	for _, role := range roles {
+		cat, ok := categoryOf[role.ID]
+		if !ok {
+			continue
+		}
+		if role.Position >= limit {
+			skipped = append(skipped, "<@&"+role.ID+"> is not below "+above+".")
+			continue
+		}
+		if catRole := findRole(guild, cat); catRole == nil || catRole.Position >= limit {
+			skipped = append(skipped, "<@&"+role.ID+"> can't be moved below <@&"+cat+">, which is not below "+above+".")
+			continue
+		}
+		children[cat] = append(children[cat], role)
+		placed[role.ID] = true
+	}
+
+	// the new order of the roles the bot can move, highest first
+	var order []*discordgo.Role
+	for _, role := range roles {
+		if role.Position >= limit || placed[role.ID] {
+			continue
+		}
+		order = append(order, role)
+		if isCategory[role.ID] {
+			order = append(order, children[role.ID]...)
+		}
+	}
+
+	var changes []*discordgo.Role
+	for n, role := range order {
+		// @everyone is always at position 0
+		position := len(order) - n
+		if role.Position != position {
+			changes = append(changes, &discordgo.Role{ID: role.ID, Position: position})
+		}
+	}
+	if len(changes) == 0 {
+		return
+	}
+	_, err = s.GuildRoleReorder(gid, changes)
+	if err != nil {
+		return
+	}
+	moved = len(changes)
+	return
+}
+
+// positionAfterChange moves roles below their categories after one of the
+// commands changed them, if the guild turned that on with /config
+// auto-position, and tells the user about anything it couldn't move.
+func positionAfterChange(s *discordgo.Session, i *discordgo.InteractionCreate, store CategoryStore) {
+	on, err := store.AutoPosition(i.GuildID)
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	if !on {
+		return
+	}
+
+	var msg string
+	_, skipped, err := layoutRoles(s, store, i.GuildID, i.Member)
+	if err != nil {
+		msg = "Could not move the roles below their categories: " + err.Error()
+	} else if len(skipped) > 0 {
+		msg = "Could not move some roles below their categories:\n" + strings.Join(skipped, "\n")
+	} else {
+		return
+	}
+
+	// disable mentions by passing a zero'd allowmentions
+	var allowedMentions discordgo.MessageAllowedMentions
+	_, err = s.FollowupMessageCreate(i.Interaction, false, &discordgo.WebhookParams{
+		Content:         msg,
+		AllowedMentions: &allowedMentions,
+	})
+	if err != nil {
+		fmt.Println(err)
+	}
+}
+
+// categoryReorder moves every role below its category at once.
+func categoryReorder(s *discordgo.Session, i *discordgo.InteractionCreate, store CategoryStore) {
+	var msgformat string
+	mr, err := checkAccess(i.Member, i.GuildID, s, store, false)
+	if err != nil || mr == false {
+		if err != nil {
+			msgformat = err.Error()
+		} else {
+			msgformat = "User does not have manage roles permission or a manager role!"
+		}
+		s.InteractionRespond(i.Interaction, &discordgo.InteractionResponse{
+			Type: discordgo.InteractionResponseChannelMessageWithSource,
+			Data: &discordgo.InteractionResponseData{
+				Content: msgformat,
+			},
+		})
+		return
+	}
+
+	moved, skipped, err := layoutRoles(s, store, i.GuildID, i.Member)
+	if err != nil {
+		msgformat = err.Error()
+	} else if moved == 0 {
+		msgformat = "Every role I can move is already below its category."
+	} else {
+		msgformat = fmt.Sprintf("Changed the position of %d roles.", moved)
+	}
+	if err == nil && len(skipped) > 0 {
+		msgformat += "\n" + strings.Join(skipped, "\n")
+	}
+	// disable mentions by passing a zero'd allowmentions
+	var allowedMentions discordgo.MessageAllowedMentions
+	s.InteractionRespond(i.Interaction, &discordgo.InteractionResponse{
+		Type: discordgo.InteractionResponseChannelMessageWithSource,
+		Data: &discordgo.InteractionResponseData{
+			AllowedMentions: &allowedMentions,
+			Content:         msgformat,
+		},
+	})
+}
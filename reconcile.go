@@ -0,0 +1,317 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+// the most members Discord returns per GuildMembers call
+const memberPageSize = 1000
+
+var (
+	// reconcileMu makes guilds reconcile one after another when the bot
+	// connects, so that connecting to many guilds at once doesn't flood the
+	// rate limits
+	reconcileMu sync.Mutex
+
+	runningMu sync.Mutex
+	running   = make(map[string]bool)
+	// guildMu keeps the member fixes within a guild from overlapping,
+	// without making them wait for other guilds
+	guildMu = make(map[string]*sync.Mutex)
+)
+
+// lockGuild waits until no other member fixes run in a guild, and returns
+// the function which lets the next one go.
+func lockGuild(gid string) (unlock func()) {
+	runningMu.Lock()
+	mu, ok := guildMu[gid]
+	if !ok {
+		mu = new(sync.Mutex)
+		guildMu[gid] = mu
+	}
+	runningMu.Unlock()
+
+	mu.Lock()
+	return mu.Unlock
+}
+
+var errReconcileRunning = errors.New("This server is already being resynced, try again once it's done!")
+
+// reconcileGuild applies the category logic from guildMemberUpdate to every
+// member of a guild, for when roles changed while the bot wasn't watching.
+// It returns how many members were checked, how many had to be fixed and for
+// how many that failed, and the members holding several roles of an exclusive
+// category, which are left for a human to sort out. A member who can't be
+// fixed doesn't stop the others, only failing to list the members does.
+// If progress isn't nil it is called with the running totals after every
+// page of members but the last.
+func reconcileGuild(s *discordgo.Session, store CategoryStore, gid string, progress func(checked int, fixed int)) (checked int, fixed int, failed int, conflicted []string, err error) {
+	runningMu.Lock()
+	if running[gid] {
+		runningMu.Unlock()
+		err = errReconcileRunning
+		return
+	}
+	running[gid] = true
+	runningMu.Unlock()
+	defer func() {
+		runningMu.Lock()
+		delete(running, gid)
+		runningMu.Unlock()
+	}()
+
+	return reconcileMembers(s, store, gid, nil, progress)
+}
+
+// reconcileMembers does the work for reconcileGuild. If roles isn't empty,
+// only the members holding at least one of them are checked.
+func reconcileMembers(s *discordgo.Session, store CategoryStore, gid string, roles []string, progress func(checked int, fixed int)) (checked int, fixed int, failed int, conflicted []string, err error) {
+	defer lockGuild(gid)()
+
+	gCat, err := store.Categories(gid)
+	if err != nil || len(gCat) == 0 {
+		return
+	}
+	gRoles, err := store.Roles(gid)
+	if err != nil {
+		return
+	}
+
+	// discordgo waits out the rate limit buckets on every request, so
+	// paging and fixing members one at a time stays within them
+	after := ""
+	for {
+		var members []*discordgo.Member
+		members, err = s.GuildMembers(gid, after, memberPageSize)
+		if err != nil {
+			return
+		}
+
+		for _, member := range members {
+			if len(roles) > 0 && !hasAnyRole(member, roles) {
+				continue
+			}
+			checked++
+			changed, conflicts, syncErr := syncMember(s, gid, member.User.ID, member.Roles, nil, gRoles, gCat)
+			if syncErr != nil {
+				// the member may have left, or a category may be above
+				// the bot, neither of which should stop the others
+				log.Printf("syncing member %s in guild %s: %v", member.User.ID, gid, syncErr)
+				failed++
+				continue
+			}
+			if changed {
+				fixed++
+			}
+			if len(conflicts) > 0 {
+				conflicted = append(conflicted, member.User.ID)
+			}
+		}
+
+		if len(members) < memberPageSize {
+			return
+		}
+		after = members[len(members)-1].User.ID
+		if progress != nil {
+			progress(checked, fixed)
+		}
+	}
+}
+
+// dropCategory takes cat away from every member of a guild who has it, and
+// returns how many members lost it and for how many that failed.
+func dropCategory(s *discordgo.Session, gid string, cat string) (fixed int, failed int, err error) {
+	defer lockGuild(gid)()
+
+	after := ""
+	for {
+		var members []*discordgo.Member
+		members, err = s.GuildMembers(gid, after, memberPageSize)
+		if err != nil {
+			return
+		}
+
+		for _, member := range members {
+			if !hasRole(member, cat) {
+				continue
+			}
+			removeErr := s.GuildMemberRoleRemove(gid, member.User.ID, cat)
+			if removeErr != nil {
+				log.Printf("removing %s from member %s in guild %s: %v", cat, member.User.ID, gid, removeErr)
+				failed++
+				continue
+			}
+			fixed++
+		}
+
+		if len(members) < memberPageSize {
+			return
+		}
+		after = members[len(members)-1].User.ID
+	}
+}
+
+// resyncMember applies the category logic from guildMemberUpdate to a single
+// member and reports whether their roles were changed, and the exclusive
+// categories they hold several roles of.
+func resyncMember(s *discordgo.Session, store CategoryStore, gid string, uid string) (changed bool, conflicts []string, err error) {
+	gCat, err := store.Categories(gid)
+	if err != nil {
+		return
+	}
+	gRoles, err := store.Roles(gid)
+	if err != nil {
+		return
+	}
+
+	member, err := s.State.Member(gid, uid)
+	if err != nil {
+		member, err = s.GuildMember(gid, uid)
+		if err != nil {
+			return
+		}
+	}
+
+	return syncMember(s, gid, uid, member.Roles, nil, gRoles, gCat)
+}
+
+// failedNotice tells the user about the members whose roles couldn't be
+// changed, or returns "" if there are none.
+func failedNotice(failed int) string {
+	if failed == 0 {
+		return ""
+	}
+	return fmt.Sprintf("\nCould not fix %d members, /diagnose shows the categories I can't give out.", failed)
+}
+
+// maxConflictMentions is how many members conflictNotice names, to stay well
+// below Discord's 2000 character message limit.
+const maxConflictMentions = 40
+
+// conflictNotice tells the user about the members left with several roles
+// from an exclusive category, or returns "" if there are none.
+func conflictNotice(members []string) string {
+	if len(members) == 0 {
+		return ""
+	}
+	var b strings.Builder
+	fmt.Fprintf(&b, "\n%d members have more than one role from an exclusive category. I can't tell which one they picked last, so remove the others by hand:", len(members))
+	for n, uid := range members {
+		if n == maxConflictMentions {
+			fmt.Fprintf(&b, " and %d more", len(members)-n)
+			break
+		}
+		fmt.Fprintf(&b, " <@%s>", uid)
+	}
+	return b.String()
+}
+
+func hasRole(member *discordgo.Member, role string) bool {
+	for _, n := range member.Roles {
+		if n == role {
+			return true
+		}
+	}
+	return false
+}
+
+func hasAnyRole(member *discordgo.Member, roles []string) bool {
+	for _, n := range roles {
+		if hasRole(member, n) {
+			return true
+		}
+	}
+	return false
+}
+
+// syncMaxMembers is the largest guild in which changing a role's category
+// fixes the members holding it right away. Bigger guilds have to use /resync.
+// Zero turns it off everywhere.
+var syncMaxMembers = 10000
+
+// applyMappingChange fixes the categories of the members holding roles after
+// one of the commands changed which category they belong to, and tells the
+// user who ran the command about it with a follow-up message. The role panels
+// are updated as well.
+func applyMappingChange(s *discordgo.Session, i *discordgo.InteractionCreate, store CategoryStore, roles ...string) {
+	go refreshPanels(s, store, i.GuildID)
+
+	who := "who already have this role"
+	if len(roles) > 1 {
+		who = "who already have these roles"
+	}
+	fixMembers(s, i, who, "Use /resync once you're done changing categories.", func() (int, int, []string, error) {
+		_, fixed, failed, conflicted, err := reconcileMembers(s, store, i.GuildID, roles, nil)
+		return fixed, failed, conflicted, err
+	})
+}
+
+// applyCategoryDelete takes a category which was just deleted away from the
+// members who have it, since nothing requires it anymore. If the role still
+// belongs to another category, members picked it themselves and keep it.
+func applyCategoryDelete(s *discordgo.Session, i *discordgo.InteractionCreate, store CategoryStore, cat string) {
+	gRoles, err := store.Roles(i.GuildID)
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	for _, k := range gRoles {
+		if k.Role == cat {
+			return
+		}
+	}
+
+	who := "who had <@&" + cat + ">"
+	fixMembers(s, i, who, "Remove it from them by hand, /resync won't since it's no longer a category.", func() (int, int, []string, error) {
+		fixed, failed, err := dropCategory(s, i.GuildID, cat)
+		return fixed, failed, nil, err
+	})
+}
+
+// fixMembers runs fix in the background and tells the user who ran the
+// command how it went, unless nothing changed. who describes the members
+// fix works on, like "who already have this role". In guilds too big to fix
+// right away, hint tells the user what to do instead.
+func fixMembers(s *discordgo.Session, i *discordgo.InteractionCreate, who string, hint string, fix func() (fixed int, failed int, conflicted []string, err error)) {
+	// disable mentions by passing a zero'd allowmentions
+	var allowedMentions discordgo.MessageAllowedMentions
+
+	guild, err := s.State.Guild(i.GuildID)
+	if syncMaxMembers <= 0 || err == nil && guild.MemberCount > syncMaxMembers {
+		_, err = s.FollowupMessageCreate(i.Interaction, false, &discordgo.WebhookParams{
+			Content:         "Members " + who + " were not updated. " + hint,
+			AllowedMentions: &allowedMentions,
+		})
+		if err != nil {
+			fmt.Println(err)
+		}
+		return
+	}
+
+	go func() {
+		var msg string
+		fixed, failed, conflicted, err := fix()
+		if err != nil {
+			msg = "Could not update members " + who + ": " + err.Error()
+		} else if fixed > 0 || failed > 0 || len(conflicted) > 0 {
+			msg = fmt.Sprintf("Updated the categories of %d members %s.", fixed, who)
+			msg += failedNotice(failed)
+			msg += conflictNotice(conflicted)
+		} else {
+			return
+		}
+		_, err = s.FollowupMessageCreate(i.Interaction, false, &discordgo.WebhookParams{
+			Content:         msg,
+			AllowedMentions: &allowedMentions,
+		})
+		if err != nil {
+			fmt.Println(err)
+		}
+	}()
+}
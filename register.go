@@ -0,0 +1,155 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"strings"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+var (
+	// commandMode is "guild" to register the commands in every guild as it
+	// is joined, or "global" to register them once for all guilds.
+	// Guild commands update instantly, global ones can take a while.
+	commandMode = "guild"
+	// devGuilds limits guild mode to these guilds, if there are any
+	devGuilds []string
+	// cleanupCommands removes the commands left behind by the other mode
+	cleanupCommands bool
+)
+
+// readyCommands registers the global commands, or cleans them up, once the
+// bot is connected.
+func readyCommands(s *discordgo.Session) {
+	var err error
+	if commandMode == "global" {
+		err = registerCommands(s, "")
+	} else if cleanupCommands {
+		err = clearCommands(s, "")
+	}
+	if err != nil {
+		log.Printf("Cannot register global commands: %v", err)
+	}
+}
+
+// guildCommands registers a guild's commands, or cleans them up, when it
+// is joined.
+func guildCommands(s *discordgo.Session, gid string) {
+	var err error
+	if commandMode == "guild" && isDevGuild(gid) {
+		err = registerCommands(s, gid)
+	} else if cleanupCommands {
+		err = clearCommands(s, gid)
+	}
+	if err != nil {
+		// the bot still works in every other guild
+		log.Printf("Cannot register commands in guild %s: %v", gid, err)
+	}
+}
+
+func isDevGuild(gid string) bool {
+	if len(devGuilds) == 0 {
+		return true
+	}
+	for _, n := range devGuilds {
+		if n == gid {
+			return true
+		}
+	}
+	return false
+}
+
+// clearCommands deletes every command in a guild, or the global ones if gid
+// is empty, for when the bot switched modes.
+func clearCommands(s *discordgo.Session, gid string) error {
+	existing, err := s.ApplicationCommands(s.State.User.ID, gid)
+	if err != nil || len(existing) == 0 {
+		return err
+	}
+	_, err = s.ApplicationCommandBulkOverwrite(s.State.User.ID, gid, []*discordgo.ApplicationCommand{})
+	return err
+}
+
+// registerCommands makes a guild's commands, or the global ones if gid is
+// empty, match the commands slice. It only talks to Discord again if
+// something changed, and then replaces them all with one bulk overwrite.
+func registerCommands(s *discordgo.Session, gid string) error {
+	existing, err := s.ApplicationCommands(s.State.User.ID, gid)
+	if err != nil {
+		return err
+	}
+	global := gid == ""
+	cmds := commands
+	if !global {
+		cmds = withoutContexts(commands)
+	}
+	if sameCommands(existing, cmds, global) {
+		return nil
+	}
+
+	_, err = s.ApplicationCommandBulkOverwrite(s.State.User.ID, gid, cmds)
+	return err
+}
+
+// withoutContexts copies cmds without their contexts. Discord only uses them
+// for global commands, guild commands can't be used outside their guild
+// anyway, and it ignores them there.
+func withoutContexts(cmds []*discordgo.ApplicationCommand) []*discordgo.ApplicationCommand {
+	stripped := make([]*discordgo.ApplicationCommand, len(cmds))
+	for n, cmd := range cmds {
+		c := *cmd
+		c.Contexts = nil
+		stripped[n] = &c
+	}
+	return stripped
+}
+
+// sameCommands reports whether two sets of commands look the same to users,
+// ignoring the IDs and versions Discord adds. Contexts are only compared for
+// global commands, see withoutContexts.
+func sameCommands(a []*discordgo.ApplicationCommand, b []*discordgo.ApplicationCommand, global bool) bool {
+	if len(a) != len(b) {
+		return false
+	}
+
+	signatures := make(map[string]bool)
+	for _, cmd := range a {
+		signatures[commandSignature(cmd, global)] = true
+	}
+	for _, cmd := range b {
+		if !signatures[commandSignature(cmd, global)] {
+			return false
+		}
+	}
+	return true
+}
+
+func commandSignature(cmd *discordgo.ApplicationCommand, global bool) string {
+	var perms int64 = -1
+	if cmd.DefaultMemberPermissions != nil {
+		perms = *cmd.DefaultMemberPermissions
+	}
+	var contexts []discordgo.InteractionContextType
+	if global && cmd.Contexts != nil {
+		contexts = *cmd.Contexts
+	}
+	return fmt.Sprintf("%s|%s|%d|%v|%s", cmd.Name, cmd.Description, perms, contexts, optionsSignature(cmd.Options))
+}
+
+func optionsSignature(options []*discordgo.ApplicationCommandOption) string {
+	var b strings.Builder
+	for _, o := range options {
+		var min float64
+		if o.MinValue != nil {
+			min = *o.MinValue
+		}
+		fmt.Fprintf(&b, "(%d|%s|%s|%t|%t|%v|%v|", o.Type, o.Name, o.Description, o.Required, o.Autocomplete, min, o.MaxValue)
+		for _, c := range o.Choices {
+			fmt.Fprintf(&b, "%s=%v,", c.Name, c.Value)
+		}
+		b.WriteString(optionsSignature(o.Options))
+		b.WriteString(")")
+	}
+	return b.String()
+}
@@ -0,0 +1,200 @@
+package main
+
+import (
+	"errors"
+	"time"
+)
+
+// CategoryStore is everything the command handlers and the member sync need
+// from a database. Errors returned by the mutating methods are shown to the
+// user as-is, so keep them readable.
+type CategoryStore interface {
+	// AddCategory registers a role as a category.
+	AddCategory(cat string, gid string) error
+	// RemoveCategory unregisters a category and every role assigned to it.
+	RemoveCategory(cat string, gid string) error
+	// SetCategory assigns a role to a category. A role can belong to any
+	// number of categories.
+	SetCategory(cat string, role string, gid string) error
+	// SetCategories assigns several roles to a category with a single
+	// write. Roles which can't be assigned are skipped and returned in
+	// failed with the reason. err is set when none of them could be.
+	SetCategories(cat string, roles []string, gid string) (failed map[string]error, err error)
+	// UpdateCategory moves an assigned role to a different category,
+	// taking it out of every other category it was in.
+	UpdateCategory(cat string, role string, gid string) error
+	// UnsetCategory removes a role from cat, or from every category if cat
+	// is empty.
+	UnsetCategory(cat string, role string, gid string) error
+	// SetExclusive changes whether members may only hold one of a
+	// category's roles at a time.
+	SetExclusive(cat string, exclusive bool, gid string) error
+	// SetThreshold changes how many of a category's roles members need
+	// before they get the category.
+	SetThreshold(cat string, minCount int, gid string) error
+
+	// Categories returns every category in a guild.
+	Categories(gid string) ([]categoryHolder, error)
+	// Roles returns every role which is assigned to a category in a guild.
+	Roles(gid string) ([]roleHolder, error)
+
+	// AddManager lets members with role use the commands which change
+	// categories, or only the ones which list them if readOnly is set.
+	// Adding a role which is already a manager changes its access.
+	AddManager(role string, readOnly bool, gid string) error
+	// RemoveManager takes a role's access away again.
+	RemoveManager(role string, gid string) error
+	// Managers returns every manager role in a guild.
+	Managers(gid string) ([]managerHolder, error)
+
+	// AddPanel remembers a role panel posted by /category panel, so that
+	// it can be updated when the category changes.
+	AddPanel(cat string, channel string, message string, gid string) error
+	// RemovePanel forgets a role panel. Forgetting one which isn't stored
+	// isn't an error.
+	RemovePanel(message string, gid string) error
+	// Panels returns every role panel in a guild.
+	Panels(gid string) ([]panelHolder, error)
+
+	// SetAutoPosition turns moving roles below their category on or off.
+	SetAutoPosition(on bool, gid string) error
+	// AutoPosition reports whether roles are moved below their category.
+	AutoPosition(gid string) (bool, error)
+
+	// ArchiveGuild moves everything stored for a guild aside until expires,
+	// for when the bot is removed from it. It reports whether there was
+	// anything to archive.
+	ArchiveGuild(gid string, expires time.Time) (bool, error)
+	// RestoreGuild brings back a guild archived by ArchiveGuild, unless the
+	// archive expired or the guild was set up again in the meantime. It
+	// reports whether anything was restored.
+	RestoreGuild(gid string) (bool, error)
+	// DeleteGuild deletes everything stored for a guild, its archive
+	// included, for when archives aren't kept. It reports whether there
+	// was anything to delete.
+	DeleteGuild(gid string) (bool, error)
+	// PurgeArchives deletes every archive which expired before now.
+	PurgeArchives(now time.Time) error
+}
+
+// Errors shared by every CategoryStore, so that users see the same message
+// whichever database the bot runs on.
+var (
+	errNotUnset        = errors.New("Did not unset any categories!")
+	errNoCategories    = errors.New("No categories registered! Register a category with /category create")
+	errNotCategory     = errors.New("Category is not a category!")
+	errNoRoles         = errors.New("No roles set! Set a role to a category with /category add-role")
+	errNotUpdated      = errors.New("Did not update any roles! Is the role registered to a category?")
+	errNotDeleted      = errors.New("Did not delete any categories!")
+	errRoleIsCategory  = errors.New("Role is a category!")
+	errHasCategory     = errors.New("Role already belongs to this category!")
+	errAlreadyCategory = errors.New("Role is already a category!")
+	errNotManager      = errors.New("Role is not a manager!")
+)
+
+// i am so horrible at naming things
+type catRoles struct {
+	Category  string
+	Roles     []string
+	Exclusive bool
+	MinCount  int
+}
+
+// roleHolder assigns a role to one category. A role in several categories
+// has one roleHolder for each of them.
+type roleHolder struct {
+	Role     string
+	Category string
+}
+
+type categoryHolder struct {
+	Role string
+	// Exclusive categories let members hold only one of their roles.
+	Exclusive bool
+	// MinCount is how many of its roles members need to get the category.
+	// Zero means one, like for categories from before it existed.
+	MinCount int
+}
+
+// minRoles is how many of the category's roles members need to get it.
+func (c categoryHolder) minRoles() int {
+	if c.MinCount < 1 {
+		return 1
+	}
+	return c.MinCount
+}
+
+// managerHolder is a role which may use the commands without having the
+// manage roles permission.
+type managerHolder struct {
+	Role     string
+	ReadOnly bool
+}
+
+// panelHolder is a message with select menus for picking a category's roles.
+type panelHolder struct {
+	Category string
+	Channel  string
+	Message  string
+}
+
+// guildArchive is what ArchiveGuild keeps of a guild.
+type guildArchive struct {
+	Categories   []categoryHolder
+	Roles        []roleHolder
+	Managers     []managerHolder
+	Panels       []panelHolder
+	AutoPosition bool
+}
+
+func listRoles(gid string, store CategoryStore) (ret []catRoles, err error) {
+	cats, err := store.Categories(gid)
+	if err != nil {
+		return
+	}
+	if len(cats) == 0 {
+		err = errors.New("No categories to list! Register a category with /category create")
+		return
+	}
+
+	roles, err := store.Roles(gid)
+	if err != nil {
+		return
+	}
+
+	for _, n := range roles {
+		found := false
+		for i, k := range ret {
+			if k.Category == n.Category {
+				ret[i].Roles = append(ret[i].Roles, n.Role)
+				found = true
+				break
+			}
+		}
+		if found == false {
+			var tmp catRoles
+			tmp.Category = n.Category
+			tmp.Roles = append(tmp.Roles, n.Role)
+			ret = append(ret, tmp)
+		}
+	}
+	for _, n := range cats {
+		found := false
+		for i, k := range ret {
+			if k.Category == n.Role {
+				ret[i].Exclusive = n.Exclusive
+				ret[i].MinCount = n.MinCount
+				found = true
+				break
+			}
+		}
+		if found == false {
+			var tmp catRoles
+			tmp.Category = n.Role
+			tmp.Exclusive = n.Exclusive
+			tmp.MinCount = n.MinCount
+			ret = append(ret, tmp)
+		}
+	}
+	return
+}
@@ -0,0 +1,398 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// memoryStore keeps everything in process memory. Nothing survives a restart,
+// which makes it useful for tests and throwaway staging guilds.
+type memoryStore struct {
+	mu         sync.Mutex
+	categories map[string][]categoryHolder
+	roles      map[string][]roleHolder
+	managers   map[string][]managerHolder
+	panels     map[string][]panelHolder
+	positioned map[string]bool
+	archives   map[string]memoryArchive
+}
+
+type memoryArchive struct {
+	guildArchive
+	expires time.Time
+}
+
+func newMemoryStore() *memoryStore {
+	return &memoryStore{
+		categories: make(map[string][]categoryHolder),
+		roles:      make(map[string][]roleHolder),
+		managers:   make(map[string][]managerHolder),
+		panels:     make(map[string][]panelHolder),
+		positioned: make(map[string]bool),
+		archives:   make(map[string]memoryArchive),
+	}
+}
+
+func (m *memoryStore) isCategory(cat string, gid string) bool {
+	for _, k := range m.categories[gid] {
+		if k.Role == cat {
+			return true
+		}
+	}
+	return false
+}
+
+// AddCategory implements CategoryStore.
+func (m *memoryStore) AddCategory(cat string, gid string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.isCategory(cat, gid) {
+		return errAlreadyCategory
+	}
+	m.categories[gid] = append(m.categories[gid], categoryHolder{Role: cat})
+	return nil
+}
+
+// RemoveCategory implements CategoryStore.
+func (m *memoryStore) RemoveCategory(cat string, gid string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if !m.isCategory(cat, gid) {
+		return errNotDeleted
+	}
+
+	var cats []categoryHolder
+	for _, k := range m.categories[gid] {
+		if k.Role != cat {
+			cats = append(cats, k)
+		}
+	}
+	m.categories[gid] = cats
+
+	var roles []roleHolder
+	for _, k := range m.roles[gid] {
+		if k.Category != cat {
+			roles = append(roles, k)
+		}
+	}
+	m.roles[gid] = roles
+	return nil
+}
+
+// SetCategory implements CategoryStore.
+func (m *memoryStore) SetCategory(cat string, role string, gid string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if len(m.categories[gid]) == 0 {
+		return errNoCategories
+	}
+	if m.isCategory(role, gid) {
+		return errRoleIsCategory
+	}
+	if !m.isCategory(cat, gid) {
+		return errNotCategory
+	}
+	for _, k := range m.roles[gid] {
+		if k.Role == role && k.Category == cat {
+			return errHasCategory
+		}
+	}
+
+	m.roles[gid] = append(m.roles[gid], roleHolder{Role: role, Category: cat})
+	return nil
+}
+
+// SetCategories implements CategoryStore.
+func (m *memoryStore) SetCategories(cat string, roles []string, gid string) (map[string]error, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if len(m.categories[gid]) == 0 {
+		return nil, errNoCategories
+	}
+	if !m.isCategory(cat, gid) {
+		return nil, errNotCategory
+	}
+
+	failed := make(map[string]error)
+	assigned := make(map[string]bool)
+	for _, k := range m.roles[gid] {
+		if k.Category == cat {
+			assigned[k.Role] = true
+		}
+	}
+	for _, role := range roles {
+		if m.isCategory(role, gid) {
+			failed[role] = errRoleIsCategory
+			continue
+		}
+		if assigned[role] {
+			failed[role] = errHasCategory
+			continue
+		}
+		assigned[role] = true
+		m.roles[gid] = append(m.roles[gid], roleHolder{Role: role, Category: cat})
+	}
+	return failed, nil
+}
+
+// UpdateCategory implements CategoryStore.
+func (m *memoryStore) UpdateCategory(cat string, role string, gid string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if len(m.categories[gid]) == 0 {
+		return errNoCategories
+	}
+	if !m.isCategory(cat, gid) {
+		return errNotCategory
+	}
+
+	// moving a role to the only category it is already in doesn't count
+	// as an update
+	moved := false
+	var roles []roleHolder
+	for _, k := range m.roles[gid] {
+		if k.Role != role {
+			roles = append(roles, k)
+		} else if k.Category != cat {
+			moved = true
+		}
+	}
+	if !moved {
+		return errNotUpdated
+	}
+	m.roles[gid] = append(roles, roleHolder{Role: role, Category: cat})
+	return nil
+}
+
+// UnsetCategory implements CategoryStore.
+func (m *memoryStore) UnsetCategory(cat string, role string, gid string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var roles []roleHolder
+	for _, k := range m.roles[gid] {
+		if k.Role != role || cat != "" && k.Category != cat {
+			roles = append(roles, k)
+		}
+	}
+	if len(roles) == len(m.roles[gid]) {
+		return errNotUnset
+	}
+	m.roles[gid] = roles
+	return nil
+}
+
+// SetExclusive implements CategoryStore.
+func (m *memoryStore) SetExclusive(cat string, exclusive bool, gid string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for i, k := range m.categories[gid] {
+		if k.Role == cat {
+			m.categories[gid][i].Exclusive = exclusive
+			return nil
+		}
+	}
+	return errNotCategory
+}
+
+// SetThreshold implements CategoryStore.
+func (m *memoryStore) SetThreshold(cat string, minCount int, gid string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for i, k := range m.categories[gid] {
+		if k.Role == cat {
+			m.categories[gid][i].MinCount = minCount
+			return nil
+		}
+	}
+	return errNotCategory
+}
+
+// Categories implements CategoryStore.
+func (m *memoryStore) Categories(gid string) ([]categoryHolder, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return append([]categoryHolder(nil), m.categories[gid]...), nil
+}
+
+// Roles implements CategoryStore.
+func (m *memoryStore) Roles(gid string) ([]roleHolder, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return append([]roleHolder(nil), m.roles[gid]...), nil
+}
+
+// AddManager implements CategoryStore.
+func (m *memoryStore) AddManager(role string, readOnly bool, gid string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for i, k := range m.managers[gid] {
+		if k.Role == role {
+			m.managers[gid][i].ReadOnly = readOnly
+			return nil
+		}
+	}
+	m.managers[gid] = append(m.managers[gid], managerHolder{Role: role, ReadOnly: readOnly})
+	return nil
+}
+
+// RemoveManager implements CategoryStore.
+func (m *memoryStore) RemoveManager(role string, gid string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for i, k := range m.managers[gid] {
+		if k.Role == role {
+			m.managers[gid] = append(m.managers[gid][:i:i], m.managers[gid][i+1:]...)
+			return nil
+		}
+	}
+	return errNotManager
+}
+
+// Managers implements CategoryStore.
+func (m *memoryStore) Managers(gid string) ([]managerHolder, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return append([]managerHolder(nil), m.managers[gid]...), nil
+}
+
+// AddPanel implements CategoryStore.
+func (m *memoryStore) AddPanel(cat string, channel string, message string, gid string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.panels[gid] = append(m.panels[gid], panelHolder{Category: cat, Channel: channel, Message: message})
+	return nil
+}
+
+// RemovePanel implements CategoryStore.
+func (m *memoryStore) RemovePanel(message string, gid string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for i, k := range m.panels[gid] {
+		if k.Message == message {
+			m.panels[gid] = append(m.panels[gid][:i:i], m.panels[gid][i+1:]...)
+			break
+		}
+	}
+	return nil
+}
+
+// Panels implements CategoryStore.
+func (m *memoryStore) Panels(gid string) ([]panelHolder, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return append([]panelHolder(nil), m.panels[gid]...), nil
+}
+
+// SetAutoPosition implements CategoryStore.
+func (m *memoryStore) SetAutoPosition(on bool, gid string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if on {
+		m.positioned[gid] = true
+	} else {
+		delete(m.positioned, gid)
+	}
+	return nil
+}
+
+// AutoPosition implements CategoryStore.
+func (m *memoryStore) AutoPosition(gid string) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return m.positioned[gid], nil
+}
+
+// ArchiveGuild implements CategoryStore.
+func (m *memoryStore) ArchiveGuild(gid string, expires time.Time) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if len(m.categories[gid]) == 0 && len(m.roles[gid]) == 0 && len(m.managers[gid]) == 0 && len(m.panels[gid]) == 0 && !m.positioned[gid] {
+		return false, nil
+	}
+	m.archives[gid] = memoryArchive{
+		guildArchive: guildArchive{
+			Categories:   m.categories[gid],
+			Roles:        m.roles[gid],
+			Managers:     m.managers[gid],
+			Panels:       m.panels[gid],
+			AutoPosition: m.positioned[gid],
+		},
+		expires: expires,
+	}
+	delete(m.categories, gid)
+	delete(m.roles, gid)
+	delete(m.managers, gid)
+	delete(m.panels, gid)
+	delete(m.positioned, gid)
+	return true, nil
+}
+
+// RestoreGuild implements CategoryStore.
+func (m *memoryStore) RestoreGuild(gid string) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	archive, ok := m.archives[gid]
+	if !ok || !archive.expires.After(time.Now()) || len(m.categories[gid]) > 0 {
+		return false, nil
+	}
+	m.categories[gid] = archive.Categories
+	m.roles[gid] = archive.Roles
+	m.managers[gid] = archive.Managers
+	m.panels[gid] = archive.Panels
+	if archive.AutoPosition {
+		m.positioned[gid] = true
+	}
+	delete(m.archives, gid)
+	return true, nil
+}
+
+// DeleteGuild implements CategoryStore.
+func (m *memoryStore) DeleteGuild(gid string) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if len(m.categories[gid]) == 0 && len(m.roles[gid]) == 0 && len(m.managers[gid]) == 0 && len(m.panels[gid]) == 0 && !m.positioned[gid] {
+		delete(m.archives, gid)
+		return false, nil
+	}
+	delete(m.categories, gid)
+	delete(m.roles, gid)
+	delete(m.managers, gid)
+	delete(m.panels, gid)
+	delete(m.positioned, gid)
+	delete(m.archives, gid)
+	return true, nil
+}
+
+// PurgeArchives implements CategoryStore.
+func (m *memoryStore) PurgeArchives(now time.Time) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for gid, archive := range m.archives {
+		if archive.expires.Before(now) {
+			delete(m.archives, gid)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,642 @@
+package main
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// mongoConfig names the database and collections the bot uses in MongoDB.
+type mongoConfig struct {
+	URI        string `json:"uri"`
+	Database   string `json:"database"`
+	Roles      string `json:"roles"`
+	Categories string `json:"categories"`
+	Token      string `json:"token"`
+	Archive    string `json:"archive"`
+}
+
+// mongoStore keeps one document per guild in each of the categories and
+// roles collections. See DATABASE.MD for the layout.
+type mongoStore struct {
+	client *mongo.Client
+	cfg    mongoConfig
+}
+
+func newMongoStore(client *mongo.Client, cfg mongoConfig) *mongoStore {
+	return &mongoStore{client: client, cfg: cfg}
+}
+
+func (m *mongoStore) collection(name string) *mongo.Collection {
+	return m.client.Database(m.cfg.Database).Collection(name)
+}
+
+type guildCategories struct {
+	Guild        string
+	Categories   []categoryHolder
+	Managers     []managerHolder
+	Panels       []panelHolder
+	AutoPosition bool
+}
+
+type guildRoles struct {
+	Guild string
+	Roles []roleHolder
+}
+
+// UnsetCategory implements CategoryStore.
+func (m *mongoStore) UnsetCategory(cat string, role string, gid string) error {
+	collection := m.collection(m.cfg.Roles)
+
+	filter := bson.D{{"guild", gid}}
+	match := bson.D{{"role", role}}
+	if cat != "" {
+		match = append(match, bson.E{"category", cat})
+	}
+	res, err := collection.UpdateOne(context.Background(), filter, bson.D{{"$pull", bson.D{{"roles", match}}}})
+	if err != nil {
+		return err
+	}
+	if res.ModifiedCount == 0 {
+		return errNotUnset
+	}
+	return nil
+}
+
+// UpdateCategory implements CategoryStore.
+func (m *mongoStore) UpdateCategory(cat string, role string, gid string) error {
+	collection := m.collection(m.cfg.Roles)
+
+	filter := bson.D{{"guild", gid}}
+	var gCat guildCategories
+	// check if new category is a category
+	err := m.collection(m.cfg.Categories).FindOne(context.Background(), filter).Decode(&gCat)
+	if err == mongo.ErrNoDocuments {
+		return errNoCategories
+	}
+	if err != nil {
+		return err
+	}
+	found := false
+	for _, k := range gCat.Categories {
+		if k.Role == cat {
+			found = true
+		}
+	}
+	if found == false {
+		return errNotCategory
+	}
+
+	var gRoles guildRoles
+	err = collection.FindOne(context.Background(), filter).Decode(&gRoles)
+	if err == mongo.ErrNoDocuments {
+		// no roles at all, so the role isn't in any category either
+		return errNotUpdated
+	}
+	if err != nil {
+		return err
+	}
+
+	// the role leaves every other category it was in, and moving it to
+	// the only category it is already in doesn't count as an update
+	moved := false
+	roles := bson.A{}
+	for _, k := range gRoles.Roles {
+		if k.Role != role {
+			roles = append(roles, k)
+		} else if k.Category != cat {
+			moved = true
+		}
+	}
+	if moved == false {
+		return errNotUpdated
+	}
+	roles = append(roles, roleHolder{Role: role, Category: cat})
+	_, err = collection.UpdateOne(context.Background(), filter, bson.D{{"$set", bson.D{{"roles", roles}}}})
+	return err
+}
+
+// RemoveCategory implements CategoryStore.
+func (m *mongoStore) RemoveCategory(cat string, gid string) error {
+	collection := m.collection(m.cfg.Categories)
+
+	filter := bson.D{{"guild", gid}}
+	res, err := collection.UpdateOne(context.Background(), filter, bson.D{{"$pull", bson.D{{"categories", bson.D{{"role", cat}}}}}})
+	if err != nil {
+		return err
+	}
+	if res.ModifiedCount == 0 {
+		return errNotDeleted
+	}
+
+	collection = m.collection(m.cfg.Roles)
+	res, err = collection.UpdateOne(context.Background(), filter, bson.D{{"$pull", bson.D{{"roles", bson.D{{"category", cat}}}}}})
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// SetCategory implements CategoryStore.
+func (m *mongoStore) SetCategory(cat string, role string, gid string) error {
+	collection := m.collection(m.cfg.Roles)
+	filter := bson.D{{"guild", gid}}
+
+	var gCats guildCategories
+
+	err := m.collection(m.cfg.Categories).FindOne(context.Background(), filter).Decode(&gCats)
+	if err == mongo.ErrNoDocuments {
+		return errNoCategories
+	}
+	if err != nil {
+		return err
+	}
+
+	// check if this role is a category
+	// and that this category is a category
+	found := false
+	for _, k := range gCats.Categories {
+		if k.Role == role {
+			return errRoleIsCategory
+		}
+		if k.Role == cat {
+			found = true
+			break
+		}
+	}
+	if found == false {
+		return errNotCategory
+	}
+
+	var gRoles guildRoles
+
+	// check if this role already has a category
+	err = collection.FindOne(context.Background(), filter).Decode(&gRoles)
+	if err == mongo.ErrNoDocuments {
+		_, errnew := collection.InsertOne(context.Background(), bson.M{"guild": gid, "roles": bson.A{bson.D{{"role", role}, {"category", cat}}}})
+		return errnew
+	}
+	if err != nil {
+		return err
+	}
+
+	for _, k := range gRoles.Roles {
+		if k.Role == role && k.Category == cat {
+			return errHasCategory
+		}
+	}
+
+	var ins roleHolder
+	ins.Role = role
+	ins.Category = cat
+	_, err = collection.UpdateOne(context.Background(), filter, bson.D{{"$push", bson.D{{"roles", ins}}}})
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// SetCategories implements CategoryStore. It reads both documents once and
+// pushes every new role in a single update.
+func (m *mongoStore) SetCategories(cat string, roles []string, gid string) (map[string]error, error) {
+	collection := m.collection(m.cfg.Roles)
+	filter := bson.D{{"guild", gid}}
+
+	var gCats guildCategories
+
+	err := m.collection(m.cfg.Categories).FindOne(context.Background(), filter).Decode(&gCats)
+	if err == mongo.ErrNoDocuments {
+		return nil, errNoCategories
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	isCategory := make(map[string]bool)
+	for _, k := range gCats.Categories {
+		isCategory[k.Role] = true
+	}
+	if !isCategory[cat] {
+		return nil, errNotCategory
+	}
+
+	var gRoles guildRoles
+
+	err = collection.FindOne(context.Background(), filter).Decode(&gRoles)
+	exists := err == nil
+	if err != nil && err != mongo.ErrNoDocuments {
+		return nil, err
+	}
+
+	assigned := make(map[string]bool)
+	for _, k := range gRoles.Roles {
+		if k.Category == cat {
+			assigned[k.Role] = true
+		}
+	}
+
+	failed := make(map[string]error)
+	var ins bson.A
+	for _, role := range roles {
+		if isCategory[role] {
+			failed[role] = errRoleIsCategory
+			continue
+		}
+		if assigned[role] {
+			failed[role] = errHasCategory
+			continue
+		}
+		assigned[role] = true
+		ins = append(ins, roleHolder{Role: role, Category: cat})
+	}
+	if len(ins) == 0 {
+		return failed, nil
+	}
+
+	if !exists {
+		_, err = collection.InsertOne(context.Background(), bson.M{"guild": gid, "roles": ins})
+	} else {
+		_, err = collection.UpdateOne(context.Background(), filter, bson.D{{"$push", bson.D{{"roles", bson.D{{"$each", ins}}}}}})
+	}
+	if err != nil {
+		return nil, err
+	}
+	return failed, nil
+}
+
+// AddCategory implements CategoryStore.
+func (m *mongoStore) AddCategory(cat string, gid string) error {
+	collection := m.collection(m.cfg.Categories)
+
+	var guild guildCategories
+
+	// check if this role is already a category
+	filter := bson.D{{"guild", gid}}
+	err := collection.FindOne(context.Background(), filter).Decode(&guild)
+	if err == mongo.ErrNoDocuments {
+		_, errnew := collection.InsertOne(context.Background(), bson.M{"guild": gid, "categories": bson.A{bson.D{{"role", cat}}}})
+		return errnew
+	}
+	if err != nil {
+		return err
+	}
+
+	for _, n := range guild.Categories {
+		if n.Role == cat {
+			return errAlreadyCategory
+		}
+	}
+
+	var ins categoryHolder
+	ins.Role = cat
+	_, err = collection.UpdateOne(context.Background(), filter, bson.D{{"$push", bson.D{{"categories", ins}}}})
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// SetExclusive implements CategoryStore.
+func (m *mongoStore) SetExclusive(cat string, exclusive bool, gid string) error {
+	res, err := m.collection(m.cfg.Categories).UpdateOne(context.Background(),
+		bson.D{{"guild", gid}, {"categories.role", cat}},
+		bson.D{{"$set", bson.D{{"categories.$.exclusive", exclusive}}}})
+	if err != nil {
+		return err
+	}
+	if res.MatchedCount == 0 {
+		return errNotCategory
+	}
+	return nil
+}
+
+// SetThreshold implements CategoryStore.
+func (m *mongoStore) SetThreshold(cat string, minCount int, gid string) error {
+	res, err := m.collection(m.cfg.Categories).UpdateOne(context.Background(),
+		bson.D{{"guild", gid}, {"categories.role", cat}},
+		bson.D{{"$set", bson.D{{"categories.$.mincount", minCount}}}})
+	if err != nil {
+		return err
+	}
+	if res.MatchedCount == 0 {
+		return errNotCategory
+	}
+	return nil
+}
+
+// Categories implements CategoryStore.
+func (m *mongoStore) Categories(gid string) ([]categoryHolder, error) {
+	var gCats guildCategories
+
+	filter := bson.D{{"guild", gid}}
+	err := m.collection(m.cfg.Categories).FindOne(context.Background(), filter).Decode(&gCats)
+	if err == mongo.ErrNoDocuments {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return gCats.Categories, nil
+}
+
+// Roles implements CategoryStore.
+func (m *mongoStore) Roles(gid string) ([]roleHolder, error) {
+	var gRoles guildRoles
+
+	filter := bson.D{{"guild", gid}}
+	err := m.collection(m.cfg.Roles).FindOne(context.Background(), filter).Decode(&gRoles)
+	if err == mongo.ErrNoDocuments {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return gRoles.Roles, nil
+}
+
+// AddManager implements CategoryStore. Managers are kept in the guild's
+// categories document.
+func (m *mongoStore) AddManager(role string, readOnly bool, gid string) error {
+	collection := m.collection(m.cfg.Categories)
+
+	res, err := collection.UpdateOne(context.Background(),
+		bson.D{{"guild", gid}, {"managers.role", role}},
+		bson.D{{"$set", bson.D{{"managers.$.readonly", readOnly}}}})
+	if err != nil {
+		return err
+	}
+	if res.MatchedCount > 0 {
+		return nil
+	}
+
+	ins := managerHolder{Role: role, ReadOnly: readOnly}
+	_, err = collection.UpdateOne(context.Background(),
+		bson.D{{"guild", gid}},
+		bson.D{{"$push", bson.D{{"managers", ins}}}},
+		options.Update().SetUpsert(true))
+	return err
+}
+
+// RemoveManager implements CategoryStore.
+func (m *mongoStore) RemoveManager(role string, gid string) error {
+	filter := bson.D{{"guild", gid}}
+	res, err := m.collection(m.cfg.Categories).UpdateOne(context.Background(), filter, bson.D{{"$pull", bson.D{{"managers", bson.D{{"role", role}}}}}})
+	if err != nil {
+		return err
+	}
+	if res.ModifiedCount == 0 {
+		return errNotManager
+	}
+	return nil
+}
+
+// Managers implements CategoryStore.
+func (m *mongoStore) Managers(gid string) ([]managerHolder, error) {
+	var gCats guildCategories
+
+	filter := bson.D{{"guild", gid}}
+	err := m.collection(m.cfg.Categories).FindOne(context.Background(), filter).Decode(&gCats)
+	if err == mongo.ErrNoDocuments {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return gCats.Managers, nil
+}
+
+// AddPanel implements CategoryStore.
+func (m *mongoStore) AddPanel(cat string, channel string, message string, gid string) error {
+	ins := panelHolder{Category: cat, Channel: channel, Message: message}
+	_, err := m.collection(m.cfg.Categories).UpdateOne(context.Background(),
+		bson.D{{"guild", gid}},
+		bson.D{{"$push", bson.D{{"panels", ins}}}},
+		options.Update().SetUpsert(true))
+	return err
+}
+
+// RemovePanel implements CategoryStore.
+func (m *mongoStore) RemovePanel(message string, gid string) error {
+	filter := bson.D{{"guild", gid}}
+	_, err := m.collection(m.cfg.Categories).UpdateOne(context.Background(), filter, bson.D{{"$pull", bson.D{{"panels", bson.D{{"message", message}}}}}})
+	return err
+}
+
+// Panels implements CategoryStore.
+func (m *mongoStore) Panels(gid string) ([]panelHolder, error) {
+	var gCats guildCategories
+
+	filter := bson.D{{"guild", gid}}
+	err := m.collection(m.cfg.Categories).FindOne(context.Background(), filter).Decode(&gCats)
+	if err == mongo.ErrNoDocuments {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return gCats.Panels, nil
+}
+
+// SetAutoPosition implements CategoryStore.
+func (m *mongoStore) SetAutoPosition(on bool, gid string) error {
+	_, err := m.collection(m.cfg.Categories).UpdateOne(context.Background(),
+		bson.D{{"guild", gid}},
+		bson.D{{"$set", bson.D{{"autoposition", on}}}},
+		options.Update().SetUpsert(true))
+	return err
+}
+
+// AutoPosition implements CategoryStore.
+func (m *mongoStore) AutoPosition(gid string) (bool, error) {
+	var gCats guildCategories
+
+	filter := bson.D{{"guild", gid}}
+	err := m.collection(m.cfg.Categories).FindOne(context.Background(), filter).Decode(&gCats)
+	if err == mongo.ErrNoDocuments {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return gCats.AutoPosition, nil
+}
+
+// ArchiveGuild implements CategoryStore. The guild's documents are kept
+// whole inside its archive document, so nothing is lost whatever they hold.
+func (m *mongoStore) ArchiveGuild(gid string, expires time.Time) (bool, error) {
+	filter := bson.D{{"guild", gid}}
+
+	archive := bson.M{"guild": gid, "expires": expires}
+	for field, name := range map[string]string{"categories": m.cfg.Categories, "roles": m.cfg.Roles} {
+		var doc bson.M
+		err := m.collection(name).FindOne(context.Background(), filter).Decode(&doc)
+		if err == mongo.ErrNoDocuments {
+			continue
+		}
+		if err != nil {
+			return false, err
+		}
+		delete(doc, "_id")
+		archive[field] = doc
+	}
+	if len(archive) == 2 {
+		return false, nil
+	}
+
+	_, err := m.collection(m.cfg.Archive).ReplaceOne(context.Background(), filter, archive, options.Replace().SetUpsert(true))
+	if err != nil {
+		return false, err
+	}
+	for _, name := range []string{m.cfg.Categories, m.cfg.Roles} {
+		_, err = m.collection(name).DeleteOne(context.Background(), filter)
+		if err != nil {
+			return false, err
+		}
+	}
+	return true, nil
+}
+
+// RestoreGuild implements CategoryStore.
+func (m *mongoStore) RestoreGuild(gid string) (bool, error) {
+	filter := bson.D{{"guild", gid}}
+
+	var archive struct {
+		Categories bson.M
+		Roles      bson.M
+	}
+	err := m.collection(m.cfg.Archive).FindOne(context.Background(),
+		bson.D{{"guild", gid}, {"expires", bson.D{{"$gt", time.Now()}}}}).Decode(&archive)
+	if err == mongo.ErrNoDocuments {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+
+	n, err := m.collection(m.cfg.Categories).CountDocuments(context.Background(), filter)
+	if err != nil || n > 0 {
+		return false, err
+	}
+
+	if archive.Categories != nil {
+		_, err = m.collection(m.cfg.Categories).ReplaceOne(context.Background(), filter, archive.Categories, options.Replace().SetUpsert(true))
+		if err != nil {
+			return false, err
+		}
+	}
+	if archive.Roles != nil {
+		_, err = m.collection(m.cfg.Roles).ReplaceOne(context.Background(), filter, archive.Roles, options.Replace().SetUpsert(true))
+		if err != nil {
+			return false, err
+		}
+	}
+	_, err = m.collection(m.cfg.Archive).DeleteOne(context.Background(), filter)
+	if err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// DeleteGuild implements CategoryStore.
+func (m *mongoStore) DeleteGuild(gid string) (bool, error) {
+	filter := bson.D{{"guild", gid}}
+
+	var deleted int64
+	for _, name := range []string{m.cfg.Categories, m.cfg.Roles} {
+		res, err := m.collection(name).DeleteOne(context.Background(), filter)
+		if err != nil {
+			return false, err
+		}
+		deleted += res.DeletedCount
+	}
+	_, err := m.collection(m.cfg.Archive).DeleteOne(context.Background(), filter)
+	if err != nil {
+		return false, err
+	}
+	return deleted > 0, nil
+}
+
+// PurgeArchives implements CategoryStore.
+func (m *mongoStore) PurgeArchives(now time.Time) error {
+	_, err := m.collection(m.cfg.Archive).DeleteMany(context.Background(), bson.D{{"expires", bson.D{{"$lt", now}}}})
+	return err
+}
+
+// migrateMongo copies the roles, categories and token collections out of
+// database from, where versions before -mongo-db kept them, into the
+// database and collections named by cfg. Guild documents are upserted, so
+// running it twice is harmless.
+func migrateMongo(client *mongo.Client, from string, cfg mongoConfig) error {
+	src := client.Database(from)
+	dst := client.Database(cfg.Database)
+
+	for old, name := range map[string]string{"roles": cfg.Roles, "categories": cfg.Categories} {
+		if from == cfg.Database && old == name {
+			continue
+		}
+		cur, err := src.Collection(old).Find(context.Background(), bson.D{})
+		if err != nil {
+			return err
+		}
+		n := 0
+		for cur.Next(context.Background()) {
+			var doc bson.M
+			err = cur.Decode(&doc)
+			if err != nil {
+				cur.Close(context.Background())
+				return err
+			}
+			delete(doc, "_id")
+			_, err = dst.Collection(name).ReplaceOne(context.Background(),
+				bson.D{{"guild", doc["guild"]}},
+				doc,
+				options.Replace().SetUpsert(true))
+			if err != nil {
+				cur.Close(context.Background())
+				return err
+			}
+			n++
+		}
+		err = cur.Err()
+		cur.Close(context.Background())
+		if err != nil {
+			return err
+		}
+		log.Printf("migrated %d documents from %s.%s to %s.%s", n, from, old, cfg.Database, name)
+	}
+
+	if from == cfg.Database && cfg.Token == "token" {
+		return nil
+	}
+	// there is only ever one token, so leave an existing one alone
+	var token bson.M
+	err := dst.Collection(cfg.Token).FindOne(context.Background(), bson.D{}).Decode(&token)
+	if err == nil {
+		log.Printf("%s.%s already has a token, not copying it", cfg.Database, cfg.Token)
+		return nil
+	}
+	if err != mongo.ErrNoDocuments {
+		return err
+	}
+	err = src.Collection("token").FindOne(context.Background(), bson.D{}).Decode(&token)
+	if err == mongo.ErrNoDocuments {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	delete(token, "_id")
+	_, err = dst.Collection(cfg.Token).InsertOne(context.Background(), token)
+	if err != nil {
+		return err
+	}
+	log.Printf("migrated token from %s.token to %s.%s", from, cfg.Database, cfg.Token)
+	return nil
+}
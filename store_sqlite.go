@@ -0,0 +1,699 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"time"
+
+	_ "github.com/mattn/go-sqlite3"
+)
+
+const sqliteSchema = `
+CREATE TABLE IF NOT EXISTS categories (
+	guild     TEXT NOT NULL,
+	role      TEXT NOT NULL,
+	exclusive INTEGER NOT NULL DEFAULT 0,
+	min_count INTEGER NOT NULL DEFAULT 0,
+	PRIMARY KEY (guild, role)
+);
+
+CREATE TABLE IF NOT EXISTS role_categories (
+	guild    TEXT NOT NULL,
+	role     TEXT NOT NULL,
+	category TEXT NOT NULL,
+	PRIMARY KEY (guild, role, category),
+	FOREIGN KEY (guild, category) REFERENCES categories (guild, role) ON DELETE CASCADE
+);
+
+CREATE TABLE IF NOT EXISTS managers (
+	guild    TEXT NOT NULL,
+	role     TEXT NOT NULL,
+	readonly INTEGER NOT NULL,
+	PRIMARY KEY (guild, role)
+);
+
+CREATE TABLE IF NOT EXISTS panels (
+	guild    TEXT NOT NULL,
+	message  TEXT NOT NULL,
+	channel  TEXT NOT NULL,
+	category TEXT NOT NULL,
+	PRIMARY KEY (guild, message)
+);
+
+CREATE TABLE IF NOT EXISTS settings (
+	guild         TEXT PRIMARY KEY,
+	auto_position INTEGER NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS archives (
+	guild   TEXT PRIMARY KEY,
+	expires INTEGER NOT NULL,
+	data    TEXT NOT NULL
+);
+`
+
+// sqliteStore keeps categories in a single SQLite file. Removing a category
+// drops its roles through the foreign key on role_categories.
+type sqliteStore struct {
+	db *sql.DB
+}
+
+func newSQLiteStore(path string) (*sqliteStore, error) {
+	db, err := sql.Open("sqlite3", "file:"+path+"?_foreign_keys=on")
+	if err != nil {
+		return nil, err
+	}
+	// the foreign key pragma is per connection, and SQLite only allows
+	// one writer anyway
+	db.SetMaxOpenConns(1)
+
+	_, err = db.Exec(sqliteSchema)
+	if err == nil {
+		// databases made by older versions lack the newer columns
+		err = sqliteAddColumn(db, "categories", "exclusive", "INTEGER NOT NULL DEFAULT 0")
+	}
+	if err == nil {
+		err = sqliteAddColumn(db, "categories", "min_count", "INTEGER NOT NULL DEFAULT 0")
+	}
+	if err == nil {
+		err = sqliteMultiCategoryRoles(db)
+	}
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &sqliteStore{db: db}, nil
+}
+
+// sqliteMultiCategoryRoles rebuilds role_categories from older versions,
+// whose primary key only allowed each role to be in one category.
+func sqliteMultiCategoryRoles(db *sql.DB) error {
+	var pk int
+	err := db.QueryRow("SELECT pk FROM pragma_table_info('role_categories') WHERE name = 'category'").Scan(&pk)
+	if err != nil || pk > 0 {
+		return err
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec(`
+CREATE TABLE role_categories_new (
+	guild    TEXT NOT NULL,
+	role     TEXT NOT NULL,
+	category TEXT NOT NULL,
+	PRIMARY KEY (guild, role, category),
+	FOREIGN KEY (guild, category) REFERENCES categories (guild, role) ON DELETE CASCADE
+);
+INSERT INTO role_categories_new (guild, role, category) SELECT guild, role, category FROM role_categories ORDER BY rowid;
+DROP TABLE role_categories;
+ALTER TABLE role_categories_new RENAME TO role_categories;
+`)
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// sqliteAddColumn adds a column to a table unless it already has it.
+func sqliteAddColumn(db *sql.DB, table string, column string, decl string) error {
+	rows, err := db.Query("SELECT name FROM pragma_table_info(?)", table)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var name string
+		err = rows.Scan(&name)
+		if err != nil {
+			return err
+		}
+		if name == column {
+			return nil
+		}
+	}
+	err = rows.Err()
+	if err != nil {
+		return err
+	}
+	rows.Close()
+
+	_, err = db.Exec("ALTER TABLE " + table + " ADD COLUMN " + column + " " + decl)
+	return err
+}
+
+// Close closes the database file.
+func (m *sqliteStore) Close() error {
+	return m.db.Close()
+}
+
+// sqliteExists runs a query returning rows and reports whether it returned any.
+func sqliteExists(tx *sql.Tx, query string, args ...interface{}) (bool, error) {
+	var one int
+	err := tx.QueryRow(query, args...).Scan(&one)
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// AddCategory implements CategoryStore.
+func (m *sqliteStore) AddCategory(cat string, gid string) error {
+	tx, err := m.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	found, err := sqliteExists(tx, "SELECT 1 FROM categories WHERE guild = ? AND role = ?", gid, cat)
+	if err != nil {
+		return err
+	}
+	if found {
+		return errAlreadyCategory
+	}
+
+	_, err = tx.Exec("INSERT INTO categories (guild, role) VALUES (?, ?)", gid, cat)
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// RemoveCategory implements CategoryStore.
+func (m *sqliteStore) RemoveCategory(cat string, gid string) error {
+	res, err := m.db.Exec("DELETE FROM categories WHERE guild = ? AND role = ?", gid, cat)
+	if err != nil {
+		return err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return errNotDeleted
+	}
+	return nil
+}
+
+// SetCategory implements CategoryStore.
+func (m *sqliteStore) SetCategory(cat string, role string, gid string) error {
+	tx, err := m.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	found, err := sqliteExists(tx, "SELECT 1 FROM categories WHERE guild = ?", gid)
+	if err != nil {
+		return err
+	}
+	if !found {
+		return errNoCategories
+	}
+
+	found, err = sqliteExists(tx, "SELECT 1 FROM categories WHERE guild = ? AND role = ?", gid, role)
+	if err != nil {
+		return err
+	}
+	if found {
+		return errRoleIsCategory
+	}
+
+	found, err = sqliteExists(tx, "SELECT 1 FROM categories WHERE guild = ? AND role = ?", gid, cat)
+	if err != nil {
+		return err
+	}
+	if !found {
+		return errNotCategory
+	}
+
+	found, err = sqliteExists(tx, "SELECT 1 FROM role_categories WHERE guild = ? AND role = ? AND category = ?", gid, role, cat)
+	if err != nil {
+		return err
+	}
+	if found {
+		return errHasCategory
+	}
+
+	_, err = tx.Exec("INSERT INTO role_categories (guild, role, category) VALUES (?, ?, ?)", gid, role, cat)
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// SetCategories implements CategoryStore.
+func (m *sqliteStore) SetCategories(cat string, roles []string, gid string) (map[string]error, error) {
+	tx, err := m.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	found, err := sqliteExists(tx, "SELECT 1 FROM categories WHERE guild = ?", gid)
+	if err != nil {
+		return nil, err
+	}
+	if !found {
+		return nil, errNoCategories
+	}
+
+	found, err = sqliteExists(tx, "SELECT 1 FROM categories WHERE guild = ? AND role = ?", gid, cat)
+	if err != nil {
+		return nil, err
+	}
+	if !found {
+		return nil, errNotCategory
+	}
+
+	failed := make(map[string]error)
+	for _, role := range roles {
+		found, err = sqliteExists(tx, "SELECT 1 FROM categories WHERE guild = ? AND role = ?", gid, role)
+		if err != nil {
+			return nil, err
+		}
+		if found {
+			failed[role] = errRoleIsCategory
+			continue
+		}
+
+		found, err = sqliteExists(tx, "SELECT 1 FROM role_categories WHERE guild = ? AND role = ? AND category = ?", gid, role, cat)
+		if err != nil {
+			return nil, err
+		}
+		if found {
+			failed[role] = errHasCategory
+			continue
+		}
+
+		_, err = tx.Exec("INSERT INTO role_categories (guild, role, category) VALUES (?, ?, ?)", gid, role, cat)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return failed, tx.Commit()
+}
+
+// UpdateCategory implements CategoryStore.
+func (m *sqliteStore) UpdateCategory(cat string, role string, gid string) error {
+	tx, err := m.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	found, err := sqliteExists(tx, "SELECT 1 FROM categories WHERE guild = ?", gid)
+	if err != nil {
+		return err
+	}
+	if !found {
+		return errNoCategories
+	}
+
+	found, err = sqliteExists(tx, "SELECT 1 FROM categories WHERE guild = ? AND role = ?", gid, cat)
+	if err != nil {
+		return err
+	}
+	if !found {
+		return errNotCategory
+	}
+
+	res, err := tx.Exec("DELETE FROM role_categories WHERE guild = ? AND role = ? AND category <> ?", gid, role, cat)
+	if err != nil {
+		return err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return errNotUpdated
+	}
+	_, err = tx.Exec("INSERT OR IGNORE INTO role_categories (guild, role, category) VALUES (?, ?, ?)", gid, role, cat)
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// UnsetCategory implements CategoryStore.
+func (m *sqliteStore) UnsetCategory(cat string, role string, gid string) error {
+	res, err := m.db.Exec("DELETE FROM role_categories WHERE guild = ? AND role = ? AND (? = '' OR category = ?)", gid, role, cat, cat)
+	if err != nil {
+		return err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return errNotUnset
+	}
+	return nil
+}
+
+// SetExclusive implements CategoryStore.
+func (m *sqliteStore) SetExclusive(cat string, exclusive bool, gid string) error {
+	res, err := m.db.Exec("UPDATE categories SET exclusive = ? WHERE guild = ? AND role = ?", exclusive, gid, cat)
+	if err != nil {
+		return err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return errNotCategory
+	}
+	return nil
+}
+
+// SetThreshold implements CategoryStore.
+func (m *sqliteStore) SetThreshold(cat string, minCount int, gid string) error {
+	res, err := m.db.Exec("UPDATE categories SET min_count = ? WHERE guild = ? AND role = ?", minCount, gid, cat)
+	if err != nil {
+		return err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return errNotCategory
+	}
+	return nil
+}
+
+// Categories implements CategoryStore.
+func (m *sqliteStore) Categories(gid string) (ret []categoryHolder, err error) {
+	rows, err := m.db.Query("SELECT role, exclusive, min_count FROM categories WHERE guild = ? ORDER BY rowid", gid)
+	if err != nil {
+		return
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var tmp categoryHolder
+		err = rows.Scan(&tmp.Role, &tmp.Exclusive, &tmp.MinCount)
+		if err != nil {
+			return
+		}
+		ret = append(ret, tmp)
+	}
+	err = rows.Err()
+	return
+}
+
+// Roles implements CategoryStore.
+func (m *sqliteStore) Roles(gid string) (ret []roleHolder, err error) {
+	rows, err := m.db.Query("SELECT role, category FROM role_categories WHERE guild = ? ORDER BY rowid", gid)
+	if err != nil {
+		return
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var tmp roleHolder
+		err = rows.Scan(&tmp.Role, &tmp.Category)
+		if err != nil {
+			return
+		}
+		ret = append(ret, tmp)
+	}
+	err = rows.Err()
+	return
+}
+
+// AddManager implements CategoryStore.
+func (m *sqliteStore) AddManager(role string, readOnly bool, gid string) error {
+	_, err := m.db.Exec(`INSERT INTO managers (guild, role, readonly) VALUES (?, ?, ?)
+		ON CONFLICT (guild, role) DO UPDATE SET readonly = excluded.readonly`, gid, role, readOnly)
+	return err
+}
+
+// RemoveManager implements CategoryStore.
+func (m *sqliteStore) RemoveManager(role string, gid string) error {
+	res, err := m.db.Exec("DELETE FROM managers WHERE guild = ? AND role = ?", gid, role)
+	if err != nil {
+		return err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return errNotManager
+	}
+	return nil
+}
+
+// Managers implements CategoryStore.
+func (m *sqliteStore) Managers(gid string) (ret []managerHolder, err error) {
+	rows, err := m.db.Query("SELECT role, readonly FROM managers WHERE guild = ? ORDER BY rowid", gid)
+	if err != nil {
+		return
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var tmp managerHolder
+		err = rows.Scan(&tmp.Role, &tmp.ReadOnly)
+		if err != nil {
+			return
+		}
+		ret = append(ret, tmp)
+	}
+	err = rows.Err()
+	return
+}
+
+// AddPanel implements CategoryStore.
+func (m *sqliteStore) AddPanel(cat string, channel string, message string, gid string) error {
+	_, err := m.db.Exec("INSERT OR REPLACE INTO panels (guild, message, channel, category) VALUES (?, ?, ?, ?)", gid, message, channel, cat)
+	return err
+}
+
+// RemovePanel implements CategoryStore.
+func (m *sqliteStore) RemovePanel(message string, gid string) error {
+	_, err := m.db.Exec("DELETE FROM panels WHERE guild = ? AND message = ?", gid, message)
+	return err
+}
+
+// Panels implements CategoryStore.
+func (m *sqliteStore) Panels(gid string) (ret []panelHolder, err error) {
+	rows, err := m.db.Query("SELECT category, channel, message FROM panels WHERE guild = ? ORDER BY rowid", gid)
+	if err != nil {
+		return
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var tmp panelHolder
+		err = rows.Scan(&tmp.Category, &tmp.Channel, &tmp.Message)
+		if err != nil {
+			return
+		}
+		ret = append(ret, tmp)
+	}
+	err = rows.Err()
+	return
+}
+
+// SetAutoPosition implements CategoryStore.
+func (m *sqliteStore) SetAutoPosition(on bool, gid string) error {
+	_, err := m.db.Exec(`INSERT INTO settings (guild, auto_position) VALUES (?, ?)
+		ON CONFLICT (guild) DO UPDATE SET auto_position = excluded.auto_position`, gid, on)
+	return err
+}
+
+// AutoPosition implements CategoryStore.
+func (m *sqliteStore) AutoPosition(gid string) (on bool, err error) {
+	err = m.db.QueryRow("SELECT auto_position FROM settings WHERE guild = ?", gid).Scan(&on)
+	if err == sql.ErrNoRows {
+		err = nil
+	}
+	return
+}
+
+// ArchiveGuild implements CategoryStore. The archive is kept as JSON, since
+// nothing ever needs to query it.
+func (m *sqliteStore) ArchiveGuild(gid string, expires time.Time) (bool, error) {
+	cats, err := m.Categories(gid)
+	if err != nil {
+		return false, err
+	}
+	roles, err := m.Roles(gid)
+	if err != nil {
+		return false, err
+	}
+	managers, err := m.Managers(gid)
+	if err != nil {
+		return false, err
+	}
+	panels, err := m.Panels(gid)
+	if err != nil {
+		return false, err
+	}
+	autoPosition, err := m.AutoPosition(gid)
+	if err != nil {
+		return false, err
+	}
+	if len(cats) == 0 && len(roles) == 0 && len(managers) == 0 && len(panels) == 0 && !autoPosition {
+		return false, nil
+	}
+
+	data, err := json.Marshal(guildArchive{Categories: cats, Roles: roles, Managers: managers, Panels: panels, AutoPosition: autoPosition})
+	if err != nil {
+		return false, err
+	}
+
+	tx, err := m.db.Begin()
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec("INSERT OR REPLACE INTO archives (guild, expires, data) VALUES (?, ?, ?)", gid, expires.Unix(), string(data))
+	if err != nil {
+		return false, err
+	}
+	_, err = tx.Exec("DELETE FROM categories WHERE guild = ?", gid)
+	if err != nil {
+		return false, err
+	}
+	_, err = tx.Exec("DELETE FROM managers WHERE guild = ?", gid)
+	if err != nil {
+		return false, err
+	}
+	_, err = tx.Exec("DELETE FROM panels WHERE guild = ?", gid)
+	if err != nil {
+		return false, err
+	}
+	_, err = tx.Exec("DELETE FROM settings WHERE guild = ?", gid)
+	if err != nil {
+		return false, err
+	}
+	err = tx.Commit()
+	if err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// RestoreGuild implements CategoryStore.
+func (m *sqliteStore) RestoreGuild(gid string) (bool, error) {
+	tx, err := m.db.Begin()
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+
+	var data string
+	err = tx.QueryRow("SELECT data FROM archives WHERE guild = ? AND expires > ?", gid, time.Now().Unix()).Scan(&data)
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+
+	found, err := sqliteExists(tx, "SELECT 1 FROM categories WHERE guild = ?", gid)
+	if err != nil || found {
+		return false, err
+	}
+
+	var archive guildArchive
+	err = json.Unmarshal([]byte(data), &archive)
+	if err != nil {
+		return false, err
+	}
+	for _, k := range archive.Categories {
+		_, err = tx.Exec("INSERT INTO categories (guild, role, exclusive, min_count) VALUES (?, ?, ?, ?)", gid, k.Role, k.Exclusive, k.MinCount)
+		if err != nil {
+			return false, err
+		}
+	}
+	for _, k := range archive.Roles {
+		_, err = tx.Exec("INSERT INTO role_categories (guild, role, category) VALUES (?, ?, ?)", gid, k.Role, k.Category)
+		if err != nil {
+			return false, err
+		}
+	}
+	for _, k := range archive.Managers {
+		_, err = tx.Exec("INSERT OR REPLACE INTO managers (guild, role, readonly) VALUES (?, ?, ?)", gid, k.Role, k.ReadOnly)
+		if err != nil {
+			return false, err
+		}
+	}
+	for _, k := range archive.Panels {
+		_, err = tx.Exec("INSERT OR REPLACE INTO panels (guild, message, channel, category) VALUES (?, ?, ?, ?)", gid, k.Message, k.Channel, k.Category)
+		if err != nil {
+			return false, err
+		}
+	}
+	if archive.AutoPosition {
+		_, err = tx.Exec("INSERT OR REPLACE INTO settings (guild, auto_position) VALUES (?, ?)", gid, true)
+		if err != nil {
+			return false, err
+		}
+	}
+	_, err = tx.Exec("DELETE FROM archives WHERE guild = ?", gid)
+	if err != nil {
+		return false, err
+	}
+	return true, tx.Commit()
+}
+
+// DeleteGuild implements CategoryStore. The guild's roles go along with
+// its categories.
+func (m *sqliteStore) DeleteGuild(gid string) (bool, error) {
+	tx, err := m.db.Begin()
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+
+	// settings which are off and the archive don't count as anything to
+	// delete, like in ArchiveGuild
+	var deleted int64
+	for _, n := range []struct {
+		query  string
+		counts bool
+	}{
+		{"DELETE FROM categories WHERE guild = ?", true},
+		{"DELETE FROM managers WHERE guild = ?", true},
+		{"DELETE FROM panels WHERE guild = ?", true},
+		{"DELETE FROM settings WHERE guild = ? AND auto_position", true},
+		{"DELETE FROM settings WHERE guild = ?", false},
+		{"DELETE FROM archives WHERE guild = ?", false},
+	} {
+		res, err := tx.Exec(n.query, gid)
+		if err != nil {
+			return false, err
+		}
+		if !n.counts {
+			continue
+		}
+		rows, err := res.RowsAffected()
+		if err != nil {
+			return false, err
+		}
+		deleted += rows
+	}
+	err = tx.Commit()
+	if err != nil {
+		return false, err
+	}
+	return deleted > 0, nil
+}
+
+// PurgeArchives implements CategoryStore.
+func (m *sqliteStore) PurgeArchives(now time.Time) error {
+	_, err := m.db.Exec("DELETE FROM archives WHERE expires < ?", now.Unix())
+	return err
+}
@@ -0,0 +1,321 @@
+package main
+
+import (
+	"database/sql"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+)
+
+// newTestStores opens an empty store of every kind which doesn't need a
+// server. MongoDB isn't covered, but it has to return the same errors.
+func newTestStores(t *testing.T) map[string]CategoryStore {
+	sqlite, err := newSQLiteStore(filepath.Join(t.TempDir(), "x.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { sqlite.Close() })
+	return map[string]CategoryStore{
+		"memory": newMemoryStore(),
+		"sqlite": sqlite,
+	}
+}
+
+// storeRoles lists a guild's roles as "role/category", sorted, since the
+// stores don't have to agree on the order.
+func storeRoles(t *testing.T, st CategoryStore, gid string) []string {
+	t.Helper()
+	roles, err := st.Roles(gid)
+	if err != nil {
+		t.Fatal(err)
+	}
+	list := []string{}
+	for _, k := range roles {
+		list = append(list, k.Role+"/"+k.Category)
+	}
+	sort.Strings(list)
+	return list
+}
+
+// setupGuild makes categories c and d in guild g, with role r in c.
+func setupGuild(t *testing.T, st CategoryStore) {
+	t.Helper()
+	for _, err := range []error{
+		st.AddCategory("c", "g"),
+		st.AddCategory("d", "g"),
+		st.SetCategory("c", "r", "g"),
+	} {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestStoreErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		run  func(st CategoryStore) error
+		want error
+	}{
+		{"no categories yet", func(st CategoryStore) error { return st.SetCategory("c", "r", "other") }, errNoCategories},
+		{"category twice", func(st CategoryStore) error { return st.AddCategory("c", "g") }, errAlreadyCategory},
+		{"role in category twice", func(st CategoryStore) error { return st.SetCategory("c", "r", "g") }, errHasCategory},
+		{"role in another category", func(st CategoryStore) error { return st.SetCategory("d", "r", "g") }, nil},
+		{"role is a category", func(st CategoryStore) error { return st.SetCategory("c", "d", "g") }, errRoleIsCategory},
+		{"not a category", func(st CategoryStore) error { return st.SetCategory("x", "r", "g") }, errNotCategory},
+		{"move to not a category", func(st CategoryStore) error { return st.UpdateCategory("x", "r", "g") }, errNotCategory},
+		{"move to same category", func(st CategoryStore) error { return st.UpdateCategory("c", "r", "g") }, errNotUpdated},
+		{"move unassigned role", func(st CategoryStore) error { return st.UpdateCategory("d", "x", "g") }, errNotUpdated},
+		{"move role in guild without roles", func(st CategoryStore) error {
+			err := st.UnsetCategory("", "r", "g")
+			if err == nil {
+				err = st.UpdateCategory("d", "r", "g")
+			}
+			return err
+		}, errNotUpdated},
+		{"unset unassigned role", func(st CategoryStore) error { return st.UnsetCategory("", "x", "g") }, errNotUnset},
+		{"unset from other category", func(st CategoryStore) error { return st.UnsetCategory("d", "r", "g") }, errNotUnset},
+		{"delete not a category", func(st CategoryStore) error { return st.RemoveCategory("x", "g") }, errNotDeleted},
+	}
+
+	for _, tt := range tests {
+		for name, st := range newTestStores(t) {
+			t.Run(tt.name+"/"+name, func(t *testing.T) {
+				setupGuild(t, st)
+				if err := tt.run(st); err != tt.want {
+					t.Errorf("got %v, want %v", err, tt.want)
+				}
+			})
+		}
+	}
+}
+
+func TestStoreChanges(t *testing.T) {
+	tests := []struct {
+		name string
+		run  func(st CategoryStore) error
+		want []string
+	}{
+		{"delete category removes its roles", func(st CategoryStore) error {
+			return st.RemoveCategory("c", "g")
+		}, []string{}},
+		{"delete category keeps role in other category", func(st CategoryStore) error {
+			err := st.SetCategory("d", "r", "g")
+			if err == nil {
+				err = st.RemoveCategory("c", "g")
+			}
+			return err
+		}, []string{"r/d"}},
+		{"move role out of several categories", func(st CategoryStore) error {
+			err := st.AddCategory("e", "g")
+			if err == nil {
+				err = st.SetCategory("d", "r", "g")
+			}
+			if err == nil {
+				err = st.UpdateCategory("e", "r", "g")
+			}
+			return err
+		}, []string{"r/e"}},
+		{"move role to one of its categories", func(st CategoryStore) error {
+			err := st.SetCategory("d", "r", "g")
+			if err == nil {
+				err = st.UpdateCategory("d", "r", "g")
+			}
+			return err
+		}, []string{"r/d"}},
+		{"unset role from one category", func(st CategoryStore) error {
+			err := st.SetCategory("d", "r", "g")
+			if err == nil {
+				err = st.UnsetCategory("c", "r", "g")
+			}
+			return err
+		}, []string{"r/d"}},
+		{"unset role from every category", func(st CategoryStore) error {
+			err := st.SetCategory("d", "r", "g")
+			if err == nil {
+				err = st.UnsetCategory("", "r", "g")
+			}
+			return err
+		}, []string{}},
+	}
+
+	for _, tt := range tests {
+		for name, st := range newTestStores(t) {
+			t.Run(tt.name+"/"+name, func(t *testing.T) {
+				setupGuild(t, st)
+				if err := tt.run(st); err != nil {
+					t.Fatal(err)
+				}
+				if got := storeRoles(t, st, "g"); !reflect.DeepEqual(got, tt.want) {
+					t.Errorf("got %v, want %v", got, tt.want)
+				}
+			})
+		}
+	}
+}
+
+func TestStoreSetCategories(t *testing.T) {
+	for name, st := range newTestStores(t) {
+		t.Run(name, func(t *testing.T) {
+			setupGuild(t, st)
+			failed, err := st.SetCategories("c", []string{"a", "r", "d", "b"}, "g")
+			if err != nil {
+				t.Fatal(err)
+			}
+			want := map[string]error{"r": errHasCategory, "d": errRoleIsCategory}
+			if !reflect.DeepEqual(failed, want) {
+				t.Errorf("got %v, want %v", failed, want)
+			}
+			got := storeRoles(t, st, "g")
+			if want := []string{"a/c", "b/c", "r/c"}; !reflect.DeepEqual(got, want) {
+				t.Errorf("got %v, want %v", got, want)
+			}
+
+			_, err = st.SetCategories("x", []string{"a"}, "g")
+			if err != errNotCategory {
+				t.Errorf("got %v, want %v", err, errNotCategory)
+			}
+		})
+	}
+}
+
+func TestStoreArchive(t *testing.T) {
+	for name, st := range newTestStores(t) {
+		t.Run(name, func(t *testing.T) {
+			archived, err := st.ArchiveGuild("g", time.Now().Add(time.Hour))
+			if err != nil || archived {
+				t.Fatalf("archived an empty guild: %v %v", archived, err)
+			}
+
+			setupGuild(t, st)
+			if err := st.SetCategory("d", "r", "g"); err != nil {
+				t.Fatal(err)
+			}
+			if err := st.AddManager("m", true, "g"); err != nil {
+				t.Fatal(err)
+			}
+			if err := st.SetAutoPosition(true, "g"); err != nil {
+				t.Fatal(err)
+			}
+			want := storeRoles(t, st, "g")
+
+			archived, err = st.ArchiveGuild("g", time.Now().Add(time.Hour))
+			if err != nil || !archived {
+				t.Fatalf("did not archive: %v %v", archived, err)
+			}
+			if got := storeRoles(t, st, "g"); len(got) != 0 {
+				t.Errorf("roles left after archiving: %v", got)
+			}
+			if on, _ := st.AutoPosition("g"); on {
+				t.Error("auto-position left on after archiving")
+			}
+
+			restored, err := st.RestoreGuild("g")
+			if err != nil || !restored {
+				t.Fatalf("did not restore: %v %v", restored, err)
+			}
+			if got := storeRoles(t, st, "g"); !reflect.DeepEqual(got, want) {
+				t.Errorf("got %v, want %v", got, want)
+			}
+			managers, err := st.Managers("g")
+			if err != nil || len(managers) != 1 || managers[0] != (managerHolder{"m", true}) {
+				t.Errorf("managers not restored: %v %v", managers, err)
+			}
+			if on, _ := st.AutoPosition("g"); !on {
+				t.Error("auto-position not restored")
+			}
+			if restored, _ := st.RestoreGuild("g"); restored {
+				t.Error("restored twice")
+			}
+
+			// expired archives are neither restored nor kept
+			if _, err := st.ArchiveGuild("g", time.Now().Add(-time.Hour)); err != nil {
+				t.Fatal(err)
+			}
+			if err := st.PurgeArchives(time.Now()); err != nil {
+				t.Fatal(err)
+			}
+			if restored, _ := st.RestoreGuild("g"); restored {
+				t.Error("restored an expired archive")
+			}
+		})
+	}
+}
+
+func TestStoreDeleteGuild(t *testing.T) {
+	for name, st := range newTestStores(t) {
+		t.Run(name, func(t *testing.T) {
+			deleted, err := st.DeleteGuild("g")
+			if err != nil || deleted {
+				t.Fatalf("deleted an empty guild: %v %v", deleted, err)
+			}
+
+			setupGuild(t, st)
+			if err := st.AddManager("m", false, "g"); err != nil {
+				t.Fatal(err)
+			}
+			deleted, err = st.DeleteGuild("g")
+			if err != nil || !deleted {
+				t.Fatalf("did not delete: %v %v", deleted, err)
+			}
+			if got := storeRoles(t, st, "g"); len(got) != 0 {
+				t.Errorf("roles left after deleting: %v", got)
+			}
+			if cats, _ := st.Categories("g"); len(cats) != 0 {
+				t.Errorf("categories left after deleting: %v", cats)
+			}
+			if managers, _ := st.Managers("g"); len(managers) != 0 {
+				t.Errorf("managers left after deleting: %v", managers)
+			}
+			if restored, _ := st.RestoreGuild("g"); restored {
+				t.Error("restored a deleted guild")
+			}
+		})
+	}
+}
+
+// databases from before roles could be in several categories have the role
+// as part of role_categories' primary key
+func TestSQLiteMultiCategoryMigration(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "old.db")
+	db, err := sql.Open("sqlite3", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = db.Exec(`
+CREATE TABLE categories (guild TEXT NOT NULL, role TEXT NOT NULL, PRIMARY KEY (guild, role));
+CREATE TABLE role_categories (
+	guild TEXT NOT NULL,
+	role TEXT NOT NULL,
+	category TEXT NOT NULL,
+	PRIMARY KEY (guild, role),
+	FOREIGN KEY (guild, category) REFERENCES categories (guild, role) ON DELETE CASCADE
+);
+INSERT INTO categories VALUES ('g', 'c'), ('g', 'd');
+INSERT INTO role_categories VALUES ('g', 'r', 'c');`)
+	db.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// opening it twice makes sure the migration only runs once
+	for n := 0; n < 2; n++ {
+		st, err := newSQLiteStore(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n == 0 {
+			err = st.SetCategory("d", "r", "g")
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		got := storeRoles(t, st, "g")
+		if want := []string{"r/c", "r/d"}; !reflect.DeepEqual(got, want) {
+			t.Errorf("got %v, want %v", got, want)
+		}
+		st.Close()
+	}
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"reflect"
+	"sort"
+	"testing"
+)
+
+func TestMemberChanges(t *testing.T) {
+	// a needs two of its roles, b is exclusive, and r2 is in both
+	gCat := []categoryHolder{{Role: "a", MinCount: 2}, {Role: "b", Exclusive: true}}
+	gRoles := []roleHolder{
+		{"r1", "a"},
+		{"r2", "a"},
+		{"r2", "b"},
+		{"r3", "b"},
+		{"r4", "a"},
+	}
+
+	tests := []struct {
+		name      string
+		roles     []string
+		before    []string
+		add       []string
+		remove    []string
+		conflicts []string
+	}{
+		{"nothing to do", []string{"x"}, nil, nil, nil, nil},
+		{"below threshold", []string{"r1"}, nil, nil, nil, nil},
+		{"reaches threshold", []string{"r1", "r4"}, nil, []string{"a"}, nil, nil},
+		{"drops below threshold", []string{"r1", "a"}, nil, nil, []string{"a"}, nil},
+		{"keeps category at threshold", []string{"r1", "r4", "a"}, nil, nil, nil, nil},
+		{"counts role in several categories", []string{"r1", "r2"}, nil, []string{"a", "b"}, nil, nil},
+		{"exclusive keeps newest", []string{"r2", "r3", "b"}, []string{"r2", "b"}, nil, []string{"r2"}, nil},
+		// removing r2 from b takes it out of a as well, so a drops below two
+		{"exclusive removal counts for other categories", []string{"r1", "r2", "r3", "a", "b"}, []string{"r1", "r2", "a", "b"}, nil, []string{"r2", "a"}, nil},
+		{"exclusive without before", []string{"r2", "r3", "b"}, nil, nil, nil, []string{"b"}},
+		{"exclusive with nothing new", []string{"r2", "r3", "b"}, []string{"r2", "r3", "b"}, nil, nil, []string{"b"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			add, remove, conflicts := memberChanges(tt.roles, tt.before, gRoles, gCat)
+			sort.Strings(add)
+			sort.Strings(remove)
+			sort.Strings(tt.remove)
+			if !reflect.DeepEqual(add, tt.add) {
+				t.Errorf("added %v, want %v", add, tt.add)
+			}
+			if !reflect.DeepEqual(remove, tt.remove) {
+				t.Errorf("removed %v, want %v", remove, tt.remove)
+			}
+			if !reflect.DeepEqual(conflicts, tt.conflicts) {
+				t.Errorf("conflicts %v, want %v", conflicts, tt.conflicts)
+			}
+		})
+	}
+}
+
+func TestNewestRole(t *testing.T) {
+	tests := []struct {
+		name   string
+		roles  []string
+		before []string
+		want   string
+	}{
+		{"before unknown", []string{"a", "b"}, nil, ""},
+		{"before empty", []string{"a", "b"}, []string{}, "a"},
+		{"one new", []string{"a", "b"}, []string{"a"}, "b"},
+		{"nothing new", []string{"a", "b"}, []string{"b", "a", "c"}, ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := newestRole(tt.roles, tt.before); got != tt.want {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}